@@ -0,0 +1,389 @@
+package goengage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// BackfillJSONL reads one JSON event per line:
+	//
+	//	{"uid": "user_uid", "event": "login", "value": 1, "properties": {"browser": "Chrome"}, "timestamp": "2021-05-01T10:00:00Z", "key": "evt_1"}
+	BackfillJSONL BackfillFormat = iota
+	// BackfillCSV reads a CSV file with a header row. The uid, event and timestamp columns are required, value and key
+	// are optional, and every other column is sent as a string property.
+	BackfillCSV
+)
+
+const defaultCheckpointInterval int = 100
+
+type (
+	BackfillFormat int
+
+	// Backfill replays historical events into engage.so with Users.AddEvent, keeping their original Timestamp.
+	// Events are sent one at a time in input order, so a run interrupted by an error or a cancelled context can be
+	// resumed from CheckpointFile and continues with the first event that wasn't sent.
+	//
+	// Events are deduplicated by key: the key field or column when present, otherwise a hash of the whole event.
+	// Every key seen during the run, including the keys of events skipped when resuming, is kept in memory. The key
+	// is also sent as the event's IdempotencyKey, as a process that is killed resumes from its last checkpoint and
+	// sends the events handled since again; those are deduplicated by the API, or by Config.Dedup.
+	Backfill struct {
+		Users  UserService
+		Format BackfillFormat
+		// CheckpointFile records how many events have been handled. It is read when the run starts and written every
+		// CheckpointInterval events and when the run stops. Delete it to start over. Nothing is recorded when empty.
+		CheckpointFile string
+		// CheckpointInterval defaults to 100 events
+		CheckpointInterval int
+		// RateLimit throttles the events sent. It applies on top of the client's own rate limit.
+		RateLimit RateLimit
+		// OnError is called for events that can't be sent, either because they are invalid or because the API
+		// rejected them. The run carries on with the next event. Other errors, such as network failures, stop the run.
+		OnError func(record int, event *UserEvent, err error)
+	}
+
+	// BackfillResult counts what happened to the events of a run. Record numbers start at 0 and don't include the
+	// CSV header or blank lines.
+	BackfillResult struct {
+		// Resumed is the number of records skipped because the checkpoint showed they were already handled
+		Resumed    int
+		Sent       int
+		Duplicates int
+		Failed     int
+	}
+
+	backfillCheckpoint struct {
+		Records int `json:"records"`
+	}
+
+	backfillRecord struct {
+		Key string `json:"key"`
+		UserEvent
+	}
+
+	// backfillReader returns the records of the input one at a time, and io.EOF once they have all been read.
+	// An *invalidRecordError only affects the record it is returned for.
+	backfillReader interface {
+		next() (*backfillRecord, error)
+	}
+
+	jsonlReader struct {
+		r *bufio.Reader
+	}
+
+	csvReader struct {
+		r      *csv.Reader
+		header []string
+	}
+
+	invalidRecordError struct {
+		err error
+	}
+)
+
+// Run sends the events read from r, resuming from CheckpointFile when it exists. It returns when every event has
+// been handled, or with an error when ctx is done or an event couldn't be sent for a reason other than the event itself.
+func (b *Backfill) Run(ctx context.Context, r io.Reader) (*BackfillResult, error) {
+	if b.Users == nil {
+		return nil, errors.New("goengage: backfill users service is required")
+	}
+
+	reader, err := b.reader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint, err := b.readCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	interval := b.CheckpointInterval
+	if interval <= 0 {
+		interval = defaultCheckpointInterval
+	}
+
+	var (
+		result  BackfillResult
+		limiter = newRateLimiter(b.RateLimit)
+		seen    = map[[sha256.Size]byte]struct{}{}
+		record  = 0
+	)
+
+	// stop saves the progress made so far, so a later run picks up at the current record
+	stop := func(err error) (*BackfillResult, error) {
+		if cerr := b.writeCheckpoint(backfillCheckpoint{Records: record}); cerr != nil && err == nil {
+			err = cerr
+		}
+		return &result, err
+	}
+
+	for ; ; record++ {
+		if record > checkpoint.Records && (record-checkpoint.Records)%interval == 0 {
+			if err := b.writeCheckpoint(backfillCheckpoint{Records: record}); err != nil {
+				return &result, err
+			}
+		}
+
+		rec, err := reader.next()
+		if errors.Is(err, io.EOF) {
+			return stop(nil)
+		}
+
+		var invalid *invalidRecordError
+		if errors.As(err, &invalid) {
+			if record < checkpoint.Records {
+				result.Resumed++
+			} else {
+				result.Failed++
+				b.reportError(record, nil, invalid.err)
+			}
+			continue
+		}
+		if err != nil {
+			return stop(err)
+		}
+
+		key := rec.key()
+		_, duplicate := seen[key]
+		seen[key] = struct{}{}
+
+		if record < checkpoint.Records {
+			result.Resumed++
+			continue
+		}
+
+		if duplicate {
+			result.Duplicates++
+			continue
+		}
+
+		if err := rec.validate(); err != nil {
+			result.Failed++
+			b.reportError(record, &rec.UserEvent, err)
+			continue
+		}
+
+		if err := limiter.wait(ctx); err != nil {
+			return stop(err)
+		}
+
+		rec.IdempotencyKey = rec.Key
+		if rec.IdempotencyKey == "" {
+			rec.IdempotencyKey = "backfill:" + hex.EncodeToString(key[:])
+		}
+
+		err = addEventContext(ctx, b.Users, rec.Uid, &rec.AddUserEvent)
+		if isEventRejected(err) {
+			result.Failed++
+			b.reportError(record, &rec.UserEvent, err)
+			continue
+		}
+		if err != nil {
+			// The event is sent again when the run is resumed
+			delete(seen, key)
+			return stop(err)
+		}
+		result.Sent++
+	}
+}
+
+func (b *Backfill) reader(r io.Reader) (backfillReader, error) {
+	switch b.Format {
+	case BackfillJSONL:
+		return &jsonlReader{r: bufio.NewReader(r)}, nil
+	case BackfillCSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("goengage: unable to read csv header: %w", err)
+		}
+		return &csvReader{r: reader, header: header}, nil
+	}
+	return nil, fmt.Errorf("goengage: unsupported backfill format %v", b.Format)
+}
+
+func (b *Backfill) reportError(record int, event *UserEvent, err error) {
+	if b.OnError != nil {
+		b.OnError(record, event, err)
+	}
+}
+
+func (b *Backfill) readCheckpoint() (backfillCheckpoint, error) {
+	var checkpoint backfillCheckpoint
+	if b.CheckpointFile == "" {
+		return checkpoint, nil
+	}
+
+	content, err := os.ReadFile(b.CheckpointFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return checkpoint, fmt.Errorf("goengage: %w", err)
+	}
+
+	if err := json.Unmarshal(content, &checkpoint); err != nil {
+		return checkpoint, fmt.Errorf("goengage: invalid checkpoint %v: %w", b.CheckpointFile, err)
+	}
+	return checkpoint, nil
+}
+
+// writeCheckpoint replaces the checkpoint file atomically so an interrupted write can't corrupt it
+func (b *Backfill) writeCheckpoint(checkpoint backfillCheckpoint) error {
+	if b.CheckpointFile == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(b.CheckpointFile), filepath.Base(b.CheckpointFile)+".*")
+	if err != nil {
+		return fmt.Errorf("goengage: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("goengage: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("goengage: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), b.CheckpointFile); err != nil {
+		return fmt.Errorf("goengage: %w", err)
+	}
+	return nil
+}
+
+// isEventRejected reports whether the API refused the event itself, as opposed to failing to handle the request
+func isEventRejected(err error) bool {
+	var apiErr Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code >= 400 && apiErr.Code < 500 && apiErr.Code != http.StatusTooManyRequests &&
+			apiErr.Code != http.StatusUnauthorized && apiErr.Code != http.StatusForbidden
+	}
+
+	var validationErr *EventValidationError
+	return errors.As(err, &validationErr)
+}
+
+func (r *backfillRecord) validate() error {
+	switch {
+	case r.Uid == "":
+		return errors.New("goengage: uid is required")
+	case r.Event == "":
+		return errors.New("goengage: event is required")
+	case r.Timestamp == nil || r.Timestamp.IsZero():
+		return errors.New("goengage: timestamp is required")
+	}
+	return nil
+}
+
+// key returns the deduplication key of the record
+func (r *backfillRecord) key() [sha256.Size]byte {
+	if r.Key != "" {
+		return sha256.Sum256([]byte("key:" + r.Key))
+	}
+
+	// Map keys are sorted by encoding/json, so equal events always hash the same
+	content, _ := json.Marshal(&r.UserEvent)
+	return sha256.Sum256(append([]byte("event:"), content...))
+}
+
+func (r *jsonlReader) next() (*backfillRecord, error) {
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		var record backfillRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, &invalidRecordError{err: fmt.Errorf("goengage: invalid event: %w", err)}
+		}
+		return &record, nil
+	}
+}
+
+func (r *csvReader) next() (*backfillRecord, error) {
+	row, err := r.r.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return nil, &invalidRecordError{err: fmt.Errorf("goengage: invalid event: %w", err)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(row) != len(r.header) {
+		return nil, &invalidRecordError{err: fmt.Errorf("goengage: invalid event: expected %v columns, got %v", len(r.header), len(row))}
+	}
+
+	var record backfillRecord
+	for i, column := range r.header {
+		value := row[i]
+		switch column {
+		case "uid":
+			record.Uid = value
+		case "event":
+			record.Event = value
+		case "key":
+			record.Key = value
+		case "value":
+			if value == "" {
+				continue
+			}
+			if n, err := strconv.ParseFloat(value, 64); err == nil {
+				record.Value = n
+			} else {
+				record.Value = value
+			}
+		case "timestamp":
+			if value == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, &invalidRecordError{err: fmt.Errorf("goengage: invalid timestamp %q", value)}
+			}
+			record.Timestamp = &t
+		default:
+			if record.Properties == nil {
+				record.Properties = map[string]interface{}{}
+			}
+			record.Properties[column] = value
+		}
+	}
+
+	return &record, nil
+}
+
+func (e *invalidRecordError) Error() string {
+	return e.err.Error()
+}
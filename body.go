@@ -0,0 +1,193 @@
+package goengage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultMaxResponseSize int64 = 10 << 20
+	// maxPooledBufferSize keeps unusually large payloads from pinning memory in the pool
+	maxPooledBufferSize int = 1 << 20
+)
+
+// ErrResponseTooLarge is returned when a response body exceeds Config.MaxResponseSize
+var ErrResponseTooLarge = errors.New("goengage: response body exceeds the maximum response size")
+
+var (
+	bufferPool = sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Buffer)
+		},
+	}
+
+	gzipWriterPool = sync.Pool{
+		New: func() interface{} {
+			return gzip.NewWriter(ioutil.Discard)
+		},
+	}
+)
+
+type (
+	// requestBody is a JSON payload encoded into a pooled buffer. The buffer goes back to the pool once the caller
+	// has released it and the transport has closed every reader made from it, which covers requests being retried.
+	requestBody struct {
+		buf  *bytes.Buffer
+		refs int32
+	}
+
+	requestBodyReader struct {
+		*bytes.Reader
+		body *requestBody
+		once sync.Once
+	}
+
+	// limitedReader fails with ErrResponseTooLarge instead of silently truncating like io.LimitReader
+	limitedReader struct {
+		r         io.Reader
+		remaining int64
+	}
+)
+
+// encode marshals v into a pooled buffer. Call release once the request made from it has completed.
+func encode(v interface{}) (*requestBody, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+
+	return &requestBody{buf: buf, refs: 1}, nil
+}
+
+// reader returns a reader over the payload that holds on to the buffer until it is closed
+func (b *requestBody) reader() io.ReadCloser {
+	atomic.AddInt32(&b.refs, 1)
+	return &requestBodyReader{
+		Reader: bytes.NewReader(b.buf.Bytes()),
+		body:   b,
+	}
+}
+
+// compress replaces the payload with its gzipped version. It must be called before any reader is made.
+func (b *requestBody) compress() error {
+	compressed := bufferPool.Get().(*bytes.Buffer)
+	compressed.Reset()
+
+	gz := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(gz)
+	gz.Reset(compressed)
+
+	if _, err := gz.Write(b.buf.Bytes()); err != nil {
+		putBuffer(compressed)
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		putBuffer(compressed)
+		return err
+	}
+
+	putBuffer(b.buf)
+	b.buf = compressed
+	return nil
+}
+
+func (b *requestBody) len() int64 {
+	return int64(b.buf.Len())
+}
+
+func (b *requestBody) release() {
+	if b == nil || atomic.AddInt32(&b.refs, -1) != 0 {
+		return
+	}
+	putBuffer(b.buf)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferSize {
+		bufferPool.Put(buf)
+	}
+}
+
+func (r *requestBodyReader) Close() error {
+	r.once.Do(r.body.release)
+	return nil
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Only fail if there is more data, a body of exactly the maximum size is fine
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, ErrResponseTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// decompress returns a reader over the decoded response body along with its length, -1 if unknown
+func decompress(resp *http.Response) (io.ReadCloser, int64, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return ioutil.NopCloser(resp.Body), resp.ContentLength, nil
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if errors.Is(err, io.EOF) {
+		return ioutil.NopCloser(resp.Body), 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return gz, -1, nil
+}
+
+// decode reads a response body of the given length (-1 if unknown) into target. An empty body leaves target untouched.
+//
+// Bodies are read into a pooled buffer and unmarshalled, which allocates less than streaming them through
+// json.Decoder (see BenchmarkDecode_*). Bodies known to be too large to pool are streamed instead so they don't pin
+// large buffers.
+func decode(body io.Reader, length int64, target interface{}) error {
+	if length > int64(maxPooledBufferSize) {
+		err := json.NewDecoder(body).Decode(target)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer putBuffer(buf)
+
+	if length > 0 {
+		buf.Grow(int(length))
+	}
+
+	if _, err := buf.ReadFrom(body); err != nil {
+		return err
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+	return json.Unmarshal(buf.Bytes(), target)
+}
@@ -0,0 +1,341 @@
+package goengage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// bulkRateLimitRetries is the least number of times a request of a bulk operation is retried when rate limited
+	bulkRateLimitRetries int = 3
+	// maxBatchEvents and maxBatchSize cap the number of events and the encoded size, in bytes, of a single batch
+	maxBatchEvents int = 100
+	maxBatchSize   int = 512 * 1024
+	// batchProbeInterval is how long the client sends events one by one after the API rejected a batch as unknown,
+	// before trying batches again
+	batchProbeInterval = 10 * time.Minute
+)
+
+type (
+	BulkSubscribeResult struct {
+		Input  SubscribeListInput
+		Output *SubscribeListOutput
+		Err    error
+	}
+
+	// BulkSubscribeOutput holds one result per input, in the same order as the inputs
+	BulkSubscribeOutput struct {
+		Results []*BulkSubscribeResult
+	}
+
+	BulkUnsubscribeResult struct {
+		Uid string
+		Err error
+	}
+
+	// BulkUnsubscribeOutput holds one result per uid, in the same order as the uids
+	BulkUnsubscribeOutput struct {
+		Results []*BulkUnsubscribeResult
+	}
+
+	AddEventsResult struct {
+		Event UserEvent
+		// Duplicate is set for events skipped because their IdempotencyKey was already sent, see Config.Dedup
+		Duplicate bool
+		Err       error
+	}
+
+	// AddEventsOutput holds one result per event, in the same order as the events
+	AddEventsOutput struct {
+		Results []*AddEventsResult
+	}
+
+	addEventsInput struct {
+		Events []UserEvent `json:"events"`
+	}
+)
+
+// BulkSubscribe subscribes many users to a list using at most Config.MaxConcurrency concurrent requests.
+// Requests are retried according to Config.Retry, and rate limited ones at least 3 times. Once a request is rate
+// limited every request of the client waits for the delay requested by the API. An error is only returned for invalid
+// arguments or when ctx is done; failures of individual subscriptions are reported in the output results.
+func (l *Lists) BulkSubscribe(ctx context.Context, id string, inputs []SubscribeListInput) (*BulkSubscribeOutput, error) {
+	if id == "" {
+		return nil, errors.New("goengage: id is required")
+	}
+
+	output := &BulkSubscribeOutput{
+		Results: make([]*BulkSubscribeResult, len(inputs)),
+	}
+	for i := range inputs {
+		output.Results[i] = &BulkSubscribeResult{Input: inputs[i]}
+	}
+
+	err := l.client.runBulk(ctx, len(inputs), func(ctx context.Context, i int) {
+		result := output.Results[i]
+		result.Output, result.Err = l.subscribeList(ctx, id, &result.Input)
+	})
+
+	return output, err
+}
+
+// BulkUnsubscribe removes many users from a list using at most Config.MaxConcurrency concurrent requests.
+// It follows the same retry and error reporting rules as BulkSubscribe.
+func (l *Lists) BulkUnsubscribe(ctx context.Context, id string, uids []string) (*BulkUnsubscribeOutput, error) {
+	if id == "" {
+		return nil, errors.New("goengage: id is required")
+	}
+
+	output := &BulkUnsubscribeOutput{
+		Results: make([]*BulkUnsubscribeResult, len(uids)),
+	}
+	for i := range uids {
+		output.Results[i] = &BulkUnsubscribeResult{Uid: uids[i]}
+	}
+
+	err := l.client.runBulk(ctx, len(uids), func(ctx context.Context, i int) {
+		result := output.Results[i]
+		result.Err = l.unsubscribeList(ctx, id, result.Uid)
+	})
+
+	return output, err
+}
+
+// AddEvents adds events of many users. Events are packed into batches of at most 100 events and 512 KiB, sent using at
+// most Config.MaxConcurrency concurrent requests. When the API doesn't support batches, the client sends the events one
+// by one instead, still concurrently, and tries batches again after 10 minutes. Events with an IdempotencyKey are
+// always sent one by one, as the Idempotency-Key header applies to a whole request. Events are validated against
+// Config.Events first. Like BulkSubscribe, an error is only returned when ctx is done and each event gets its own
+// result; all events of a batch share its result.
+func (u *Users) AddEvents(ctx context.Context, events []UserEvent) (*AddEventsOutput, error) {
+	output := &AddEventsOutput{
+		Results: make([]*AddEventsResult, len(events)),
+	}
+
+	var (
+		pending []int
+		keyed   []int
+		keys    = map[string]bool{}
+	)
+	for i := range events {
+		result := &AddEventsResult{Event: events[i]}
+		output.Results[i] = result
+
+		if result.Event.Uid == "" {
+			result.Err = errors.New("goengage: uid is required")
+			continue
+		}
+
+		if result.Err = u.client.validateEvent(&result.Event.AddUserEvent); result.Err != nil {
+			continue
+		}
+
+		key := result.Event.IdempotencyKey
+		if key == "" {
+			pending = append(pending, i)
+			continue
+		}
+
+		// Later events of the call with the key of an earlier one are duplicates of it
+		if u.client.dedup != nil && keys[key] {
+			result.Duplicate = true
+			continue
+		}
+		keys[key] = true
+
+		result.Duplicate, result.Err = u.client.beginEvent(&result.Event.AddUserEvent)
+		if result.Err == nil && !result.Duplicate {
+			keyed = append(keyed, i)
+		}
+	}
+	defer func() {
+		for _, i := range keyed {
+			u.client.endEvent(&output.Results[i].Event.AddUserEvent, output.Results[i].Err == nil)
+		}
+	}()
+
+	if !u.client.batchEventsUnsupported() {
+		batches := batchEvents(output.Results, pending)
+		sent := make([]bool, len(batches))
+		// A done ctx is reported by the fallback below, which records it on the events of unsent batches
+		_ = u.client.runBulk(ctx, len(batches), func(ctx context.Context, b int) {
+			err := u.addEventBatch(ctx, output.Results, batches[b])
+			if errors.Is(err, errBatchUnsupported) {
+				return
+			}
+
+			sent[b] = true
+			for _, i := range batches[b] {
+				output.Results[i].Err = err
+			}
+		})
+
+		pending = pending[:0]
+		for b, batch := range batches {
+			if !sent[b] {
+				pending = append(pending, batch...)
+			}
+		}
+	}
+	pending = append(pending, keyed...)
+
+	err := u.client.runBulk(ctx, len(pending), func(ctx context.Context, p int) {
+		result := output.Results[pending[p]]
+		result.Err = u.sendEvent(ctx, result.Event.Uid, &result.Event.AddUserEvent)
+	})
+
+	return output, err
+}
+
+var errBatchUnsupported = errors.New("goengage: batched events are not supported")
+
+// addEventBatch sends the events of results at indexes in a single request. It returns errBatchUnsupported, and
+// remembers it for batchProbeInterval, when the API doesn't know the batch endpoint.
+func (u *Users) addEventBatch(ctx context.Context, results []*AddEventsResult, indexes []int) error {
+	if u.client.batchEventsUnsupported() {
+		return errBatchUnsupported
+	}
+
+	input := addEventsInput{Events: make([]UserEvent, len(indexes))}
+	for j, i := range indexes {
+		input.Events[j] = results[i].Event
+	}
+
+	payload, err := encode(&input)
+	if err != nil {
+		return err
+	}
+	defer payload.release()
+
+	req, err := u.client.newRequestWithContext(ctx, http.MethodPost, "/events/batch", payload)
+	if err != nil {
+		return err
+	}
+
+	var output map[string]interface{}
+	err = u.client.makeRequest(req, &output)
+
+	var apiErr Error
+	if errors.As(err, &apiErr) && (apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusMethodNotAllowed) {
+		atomic.StoreInt64(&u.client.batchUnsupportedUntil, time.Now().Add(batchProbeInterval).UnixNano())
+		return errBatchUnsupported
+	}
+	return err
+}
+
+// batchEventsUnsupported reports whether the API rejected a batch as unknown within the last batchProbeInterval
+func (c *Client) batchEventsUnsupported() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&c.batchUnsupportedUntil)
+}
+
+// batchEvents splits the events of results at indexes into batches of at most maxBatchEvents events and
+// maxBatchSize bytes. An event larger than maxBatchSize gets a batch of its own, and events that can't be encoded
+// record the error in their result instead.
+func batchEvents(results []*AddEventsResult, indexes []int) [][]int {
+	var (
+		batches [][]int
+		batch   []int
+		size    int
+	)
+
+	for _, i := range indexes {
+		encoded, err := json.Marshal(&results[i].Event)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		if len(batch) > 0 && (len(batch) >= maxBatchEvents || size+len(encoded)+1 > maxBatchSize) {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, i)
+		size += len(encoded) + 1
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// Failed returns the events that could not be added so they can be passed back to AddEvents
+func (o *AddEventsOutput) Failed() []UserEvent {
+	var failed []UserEvent
+	for _, result := range o.Results {
+		if result.Err != nil {
+			failed = append(failed, result.Event)
+		}
+	}
+	return failed
+}
+
+// Failed returns the inputs whose subscription failed so they can be passed back to BulkSubscribe
+func (o *BulkSubscribeOutput) Failed() []SubscribeListInput {
+	var failed []SubscribeListInput
+	for _, result := range o.Results {
+		if result.Err != nil {
+			failed = append(failed, result.Input)
+		}
+	}
+	return failed
+}
+
+// Failed returns the uids that could not be unsubscribed so they can be passed back to BulkUnsubscribe
+func (o *BulkUnsubscribeOutput) Failed() []string {
+	var failed []string
+	for _, result := range o.Results {
+		if result.Err != nil {
+			failed = append(failed, result.Uid)
+		}
+	}
+	return failed
+}
+
+// bulkRequestKey marks the context of the requests of bulk operations, see Client.maxRetries
+type bulkRequestKey struct{}
+
+// runBulk calls fn for every index in [0, n) using at most c.maxConcurrency goroutines. fn must record its own
+// result. Retries are left to the requests themselves, which share the client's rate limiter, so a rate limited
+// request holds off every worker. Once ctx is done the remaining items are still passed to fn so that they record the
+// context error instead of being left without a result.
+func (c *Client) runBulk(ctx context.Context, n int, fn func(ctx context.Context, i int)) error {
+	var (
+		wg      sync.WaitGroup
+		items   = make(chan int)
+		bulkCtx = context.WithValue(ctx, bulkRequestKey{}, true)
+	)
+
+	workers := c.maxConcurrency
+	if workers > n {
+		workers = n
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				fn(bulkCtx, i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		items <- i
+	}
+	close(items)
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+func isBulkRequest(ctx context.Context) bool {
+	bulk, _ := ctx.Value(bulkRequestKey{}).(bool)
+	return bulk
+}
@@ -0,0 +1,354 @@
+package goengage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheSize int           = 1000
+	defaultCacheTTL  time.Duration = time.Minute
+)
+
+type (
+	// CacheOptions configures the read-through cache of CachedUsers and CachedLists
+	CacheOptions struct {
+		// Size is the maximum number of entries kept. The least recently used entry is evicted first. Defaults to 1000.
+		Size int
+		// TTL is how long an entry is served before it is fetched again. Defaults to 1 minute.
+		TTL time.Duration
+	}
+
+	// CachedUsers wraps a UserService with an in-memory read-through cache for Get. Concurrent Gets for the same uid
+	// share a single request. Writes made through CachedUsers invalidate the user's entry; writes made elsewhere are
+	// only picked up once the entry expires. Cached outputs are shared, so treat them as read-only.
+	CachedUsers struct {
+		UserService
+		cache *lruCache
+	}
+
+	// CachedLists wraps a ListService with an in-memory read-through cache for GetList. It behaves like CachedUsers.
+	CachedLists struct {
+		ListService
+		// Users, when set, has the entries of the users subscribed or unsubscribed through CachedLists invalidated,
+		// as their lists changed. Clients built with Config.Cache set it to their CachedUsers.
+		Users *CachedUsers
+		cache *lruCache
+	}
+
+	// conditionalUserGetter and conditionalListGetter are implemented by Users and Lists. They let the cache
+	// revalidate expired entries with If-None-Match instead of downloading them again.
+	conditionalUserGetter interface {
+		getIfModified(uid string, cached *UserOutput) (*UserOutput, bool, error)
+	}
+
+	conditionalListGetter interface {
+		getListIfModified(id string, cached *ListOutput) (*ListOutput, bool, error)
+	}
+
+	lruCache struct {
+		mu         sync.Mutex
+		size       int
+		ttl        time.Duration
+		entries    map[string]*list.Element
+		order      *list.List
+		generation uint64
+		flights    map[string]*flight
+	}
+
+	lruEntry struct {
+		key       string
+		value     interface{}
+		expiresAt time.Time
+	}
+
+	// flight is a fetch in progress that concurrent callers for the same key wait on
+	flight struct {
+		done  chan struct{}
+		value interface{}
+		err   error
+	}
+)
+
+// NewCachedUserService wraps users with a read-through cache
+func NewCachedUserService(users UserService, options CacheOptions) *CachedUsers {
+	return &CachedUsers{
+		UserService: users,
+		cache:       newLruCache(options),
+	}
+}
+
+// Get returns the cached user or fetches it from the wrapped service. Expired users that came with an ETag or
+// Last-Modified validator are revalidated, and kept if the API answers 304 Not Modified.
+func (u *CachedUsers) Get(uid string) (*UserOutput, error) {
+	value, err := u.cache.get(uid, func(stale interface{}) (interface{}, error) {
+		if getter, ok := u.UserService.(conditionalUserGetter); ok {
+			cached, _ := stale.(*UserOutput)
+			output, _, err := getter.getIfModified(uid, cached)
+			return output, err
+		}
+		return u.UserService.Get(uid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*UserOutput), nil
+}
+
+// Invalidate removes the user from the cache
+func (u *CachedUsers) Invalidate(uid string) {
+	u.cache.invalidate(uid)
+}
+
+func (u *CachedUsers) UpdateAttributes(uid string, input *UpdateUserAttributesInput) (*UserOutput, error) {
+	defer u.cache.invalidate(uid)
+	return u.UserService.UpdateAttributes(uid, input)
+}
+
+func (u *CachedUsers) Delete(uid string) (*DeleteUserOutput, error) {
+	defer u.cache.invalidate(uid)
+	return u.UserService.Delete(uid)
+}
+
+func (u *CachedUsers) Merge(sourceUid, destinationUid string) (*MergeUserOutput, error) {
+	defer u.cache.invalidate(sourceUid, destinationUid)
+	return u.UserService.Merge(sourceUid, destinationUid)
+}
+
+func (u *CachedUsers) AddDevice(uid string, input *AddDeviceInput) (*UserOutput, error) {
+	defer u.cache.invalidate(uid)
+	return u.UserService.AddDevice(uid, input)
+}
+
+func (u *CachedUsers) RemoveDevice(uid, token string) error {
+	defer u.cache.invalidate(uid)
+	return u.UserService.RemoveDevice(uid, token)
+}
+
+// create passes the caller's context through to the wrapped service
+func (u *CachedUsers) create(ctx context.Context, input *CreateUserInput) (*UserOutput, error) {
+	return createContext(ctx, u.UserService, input)
+}
+
+// updateAttributes passes the caller's context through to the wrapped service
+func (u *CachedUsers) updateAttributes(ctx context.Context, uid string, input *UpdateUserAttributesInput) (*UserOutput, error) {
+	defer u.cache.invalidate(uid)
+	return updateAttributesContext(ctx, u.UserService, uid, input)
+}
+
+// addEvent passes the context of Track through to the wrapped service
+func (u *CachedUsers) addEvent(ctx context.Context, uid string, event *AddUserEvent) error {
+	return addEventContext(ctx, u.UserService, uid, event)
+}
+
+// checkEvent checks events against the wrapped service's registry
+func (u *CachedUsers) checkEvent(event *AddUserEvent) error {
+	return checkEventOf(u.UserService, event)
+}
+
+// NewCachedListService wraps lists with a read-through cache
+func NewCachedListService(lists ListService, options CacheOptions) *CachedLists {
+	return &CachedLists{
+		ListService: lists,
+		cache:       newLruCache(options),
+	}
+}
+
+// GetList returns the cached list or fetches it from the wrapped service. Expired lists are revalidated like users.
+func (l *CachedLists) GetList(id string) (*ListOutput, error) {
+	value, err := l.cache.get(id, func(stale interface{}) (interface{}, error) {
+		if getter, ok := l.ListService.(conditionalListGetter); ok {
+			cached, _ := stale.(*ListOutput)
+			output, _, err := getter.getListIfModified(id, cached)
+			return output, err
+		}
+		return l.ListService.GetList(id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*ListOutput), nil
+}
+
+// Invalidate removes the list from the cache
+func (l *CachedLists) Invalidate(id string) {
+	l.cache.invalidate(id)
+}
+
+func (l *CachedLists) UpdateList(id string, input *CreateUpdateListInput) (*ListOutput, error) {
+	defer l.cache.invalidate(id)
+	return l.ListService.UpdateList(id, input)
+}
+
+func (l *CachedLists) ArchiveList(id string) error {
+	defer l.cache.invalidate(id)
+	return l.ListService.ArchiveList(id)
+}
+
+func (l *CachedLists) SubscribeList(id string, input *SubscribeListInput) (*SubscribeListOutput, error) {
+	return l.subscribeList(context.Background(), id, input)
+}
+
+// subscribeList passes the caller's context through to the wrapped service
+func (l *CachedLists) subscribeList(ctx context.Context, id string, input *SubscribeListInput) (*SubscribeListOutput, error) {
+	defer l.cache.invalidate(id)
+	output, err := subscribeListContext(ctx, l.ListService, id, input)
+	if output != nil {
+		l.invalidateUsers(output.Uid)
+	}
+	return output, err
+}
+
+func (l *CachedLists) UnsubscribeList(id, uid string) error {
+	defer l.cache.invalidate(id)
+	defer l.invalidateUsers(uid)
+	return l.ListService.UnsubscribeList(id, uid)
+}
+
+func (l *CachedLists) BulkSubscribe(ctx context.Context, id string, inputs []SubscribeListInput) (*BulkSubscribeOutput, error) {
+	defer l.cache.invalidate(id)
+	output, err := l.ListService.BulkSubscribe(ctx, id, inputs)
+	if output != nil {
+		var uids []string
+		for _, result := range output.Results {
+			if result != nil && result.Output != nil {
+				uids = append(uids, result.Output.Uid)
+			}
+		}
+		l.invalidateUsers(uids...)
+	}
+	return output, err
+}
+
+func (l *CachedLists) BulkUnsubscribe(ctx context.Context, id string, uids []string) (*BulkUnsubscribeOutput, error) {
+	defer l.cache.invalidate(id)
+	defer l.invalidateUsers(uids...)
+	return l.ListService.BulkUnsubscribe(ctx, id, uids)
+}
+
+// invalidateUsers removes the users from the cache of Users, if any
+func (l *CachedLists) invalidateUsers(uids ...string) {
+	if l.Users == nil || len(uids) == 0 {
+		return
+	}
+	l.Users.cache.invalidate(uids...)
+}
+
+func newLruCache(options CacheOptions) *lruCache {
+	if options.Size <= 0 {
+		options.Size = defaultCacheSize
+	}
+
+	if options.TTL <= 0 {
+		options.TTL = defaultCacheTTL
+	}
+
+	return &lruCache{
+		size:    options.Size,
+		ttl:     options.TTL,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		flights: map[string]*flight{},
+	}
+}
+
+// get returns the cached value of key, or calls fetch once for all concurrent callers and caches its result.
+// fetch receives the expired value of key, if any, so it can be revalidated. A result is not cached if the cache was
+// invalidated while fetching, as it may predate the invalidating write.
+func (c *lruCache) get(key string, fetch func(stale interface{}) (interface{}, error)) (interface{}, error) {
+	var stale interface{}
+
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		if time.Now().Before(entry.expiresAt) {
+			c.order.MoveToFront(element)
+			c.mu.Unlock()
+			return entry.value, nil
+		}
+		stale = entry.value
+	}
+
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		<-f.done
+		return f.value, f.err
+	}
+
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	generation := c.generation
+	c.mu.Unlock()
+
+	f.value, f.err = fetch(stale)
+
+	c.mu.Lock()
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	if f.err == nil && generation == c.generation {
+		c.set(key, f.value)
+	} else if element, ok := c.entries[key]; ok && f.err != nil {
+		c.remove(element)
+	}
+	c.mu.Unlock()
+	close(f.done)
+
+	return f.value, f.err
+}
+
+// invalidate removes keys from the cache and detaches in-flight fetches so later callers fetch fresh values
+func (c *lruCache) invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, key := range keys {
+		if element, ok := c.entries[key]; ok {
+			c.remove(element)
+		}
+		delete(c.flights, key)
+	}
+}
+
+// contains reports whether key holds an entry that hasn't expired
+func (c *lruCache) contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	return ok && time.Now().Before(element.Value.(*lruEntry).expiresAt)
+}
+
+// reserve stores an empty entry for key unless it holds one that hasn't expired, and reports whether it did
+func (c *lruCache) reserve(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok && time.Now().Before(element.Value.(*lruEntry).expiresAt) {
+		return false
+	}
+	c.set(key, struct{}{})
+	return true
+}
+
+func (c *lruCache) set(key string, value interface{}) {
+	entry := &lruEntry{key: key, value: value, expiresAt: time.Now().Add(c.ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *lruCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*lruEntry).key)
+}
@@ -0,0 +1,333 @@
+package goengage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	cloudEventsSpecVersion  = "1.0"
+	cloudEventsContentType  = "application/cloudevents+json"
+	cloudEventsBatchType    = "application/cloudevents-batch+json"
+	cloudEventsMaxBodySize  = 1024 * 1024
+	cloudEventsHeaderPrefix = "Ce-"
+)
+
+// ErrInvalidCloudEvent is wrapped by the errors of CloudEvents that can't be parsed or converted
+var ErrInvalidCloudEvent = errors.New("goengage: invalid cloudevent")
+
+type (
+	// CloudEvent is a CloudEvents v1.0 event. See https://github.com/cloudevents/spec/blob/v1.0/spec.md
+	CloudEvent struct {
+		SpecVersion     string
+		Id              string
+		Source          string
+		Type            string
+		Subject         string
+		Time            *time.Time
+		DataContentType string
+		DataSchema      string
+		// Extensions holds the extension attributes, keyed by their lowercase name
+		Extensions map[string]interface{}
+		Data       []byte
+	}
+
+	// CloudEventConverter converts CloudEvents into user events. The event type becomes the event name, the time its
+	// timestamp and a JSON object in data its properties; other JSON data is sent as the "data" property. The source
+	// and id, which identify a CloudEvent, make up the idempotency key.
+	CloudEventConverter struct {
+		// UidExtension is the extension attribute holding the user's uid. The subject is used when it is empty.
+		UidExtension string
+		// EventName returns the name of the event. Defaults to the CloudEvent type.
+		EventName func(event *CloudEvent) string
+	}
+
+	// CloudEventsHandler is an http.Handler receiving CloudEvents in structured, batched or binary mode and adding
+	// them with Users.AddEvent. Every event of a request is converted and checked against Config.Events before any
+	// is sent, and the request is rejected with 400 if one is invalid. A batch isn't atomic though: when the API
+	// fails some events, the others are still added and the response lists the failed ones by id, so a retried
+	// batch sends again the events that went through. Those carry the same idempotency key.
+	CloudEventsHandler struct {
+		Users     UserService
+		Converter CloudEventConverter
+	}
+)
+
+// ParseCloudEvents reads the CloudEvents of an HTTP request. Structured (application/cloudevents+json) and batched
+// (application/cloudevents-batch+json) requests carry the events in the body, and anything else is read in binary
+// mode, where the attributes are ce- headers and the body is the data.
+func ParseCloudEvents(r *http.Request) ([]*CloudEvent, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, cloudEventsMaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > cloudEventsMaxBodySize {
+		return nil, fmt.Errorf("%w: body is larger than %v bytes", ErrInvalidCloudEvent, cloudEventsMaxBodySize)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case cloudEventsContentType:
+		event, err := parseStructuredCloudEvent(body)
+		if err != nil {
+			return nil, err
+		}
+		return []*CloudEvent{event}, nil
+
+	case cloudEventsBatchType:
+		var raw []json.RawMessage
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCloudEvent, err)
+		}
+
+		events := make([]*CloudEvent, len(raw))
+		for i := range raw {
+			if events[i], err = parseStructuredCloudEvent(raw[i]); err != nil {
+				return nil, err
+			}
+		}
+		return events, nil
+	}
+
+	event, err := parseBinaryCloudEvent(r.Header, body)
+	if err != nil {
+		return nil, err
+	}
+	return []*CloudEvent{event}, nil
+}
+
+func parseStructuredCloudEvent(body []byte) (*CloudEvent, error) {
+	var attributes map[string]json.RawMessage
+	if err := json.Unmarshal(body, &attributes); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCloudEvent, err)
+	}
+
+	event := &CloudEvent{}
+	for name, raw := range attributes {
+		switch name {
+		case "data":
+			event.Data = raw
+			continue
+		case "data_base64":
+			var encoded string
+			if err := json.Unmarshal(raw, &encoded); err != nil {
+				return nil, fmt.Errorf("%w: data_base64 must be a string", ErrInvalidCloudEvent)
+			}
+
+			data, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidCloudEvent, err)
+			}
+			event.Data = data
+			continue
+		}
+
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCloudEvent, err)
+		}
+		if err := event.setAttribute(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	// Structured JSON data without a content type is JSON
+	if _, ok := attributes["data"]; ok && event.DataContentType == "" {
+		event.DataContentType = "application/json"
+	}
+
+	return event, event.validate()
+}
+
+func parseBinaryCloudEvent(header http.Header, body []byte) (*CloudEvent, error) {
+	event := &CloudEvent{DataContentType: header.Get("Content-Type")}
+	if len(body) > 0 {
+		event.Data = body
+	}
+
+	for key, values := range header {
+		if !strings.HasPrefix(key, cloudEventsHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+
+		// Header values are percent-encoded
+		value, err := url.PathUnescape(values[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid %v header", ErrInvalidCloudEvent, key)
+		}
+
+		if err := event.setAttribute(strings.ToLower(strings.TrimPrefix(key, cloudEventsHeaderPrefix)), value); err != nil {
+			return nil, err
+		}
+	}
+
+	return event, event.validate()
+}
+
+// setAttribute sets a context attribute. Attributes other than the ones of the spec are extensions.
+func (e *CloudEvent) setAttribute(name string, value interface{}) error {
+	s, isString := value.(string)
+	target := map[string]*string{
+		"specversion":     &e.SpecVersion,
+		"id":              &e.Id,
+		"source":          &e.Source,
+		"type":            &e.Type,
+		"subject":         &e.Subject,
+		"datacontenttype": &e.DataContentType,
+		"dataschema":      &e.DataSchema,
+	}
+
+	if name == "time" {
+		t, err := time.Parse(time.RFC3339, s)
+		if !isString || err != nil {
+			return fmt.Errorf("%w: time must be an RFC 3339 timestamp", ErrInvalidCloudEvent)
+		}
+		e.Time = &t
+		return nil
+	}
+
+	if field, ok := target[name]; ok {
+		if !isString {
+			return fmt.Errorf("%w: %v must be a string", ErrInvalidCloudEvent, name)
+		}
+		*field = s
+		return nil
+	}
+
+	if e.Extensions == nil {
+		e.Extensions = map[string]interface{}{}
+	}
+	e.Extensions[name] = value
+	return nil
+}
+
+func (e *CloudEvent) validate() error {
+	switch {
+	case e.SpecVersion != cloudEventsSpecVersion:
+		return fmt.Errorf("%w: unsupported specversion %q", ErrInvalidCloudEvent, e.SpecVersion)
+	case e.Id == "":
+		return fmt.Errorf("%w: id is required", ErrInvalidCloudEvent)
+	case e.Source == "":
+		return fmt.Errorf("%w: source is required", ErrInvalidCloudEvent)
+	case e.Type == "":
+		return fmt.Errorf("%w: type is required", ErrInvalidCloudEvent)
+	}
+	return nil
+}
+
+// Convert returns the uid and the user event of a CloudEvent
+func (c *CloudEventConverter) Convert(event *CloudEvent) (string, *AddUserEvent, error) {
+	uid := event.Subject
+	if c.UidExtension != "" {
+		uid, _ = event.Extensions[strings.ToLower(c.UidExtension)].(string)
+	}
+	if uid == "" {
+		return "", nil, fmt.Errorf("%w: event %v has no uid", ErrInvalidCloudEvent, event.Id)
+	}
+
+	name := event.Type
+	if c.EventName != nil {
+		name = c.EventName(event)
+	}
+
+	output := &AddUserEvent{
+		Event:          name,
+		Timestamp:      event.Time,
+		IdempotencyKey: event.Source + "/" + event.Id,
+	}
+
+	if len(event.Data) == 0 {
+		return uid, output, nil
+	}
+
+	if !isJSONContentType(event.DataContentType) {
+		return "", nil, fmt.Errorf("%w: unsupported datacontenttype %q", ErrInvalidCloudEvent, event.DataContentType)
+	}
+
+	var data interface{}
+	decoder := json.NewDecoder(bytes.NewReader(event.Data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidCloudEvent, err)
+	}
+
+	if properties, ok := data.(map[string]interface{}); ok {
+		output.Properties = properties
+	} else if data != nil {
+		output.Properties = map[string]interface{}{"data": data}
+	}
+	return uid, output, nil
+}
+
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func (h *CloudEventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	events, err := ParseCloudEvents(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Every event is converted and checked first, so a batch with an invalid event is rejected before any is sent
+	uids := make([]string, len(events))
+	inputs := make([]*AddUserEvent, len(events))
+	for i, event := range events {
+		uid, input, err := h.Converter.Convert(event)
+		if err == nil {
+			err = checkEventOf(h.Users, input)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		uids[i], inputs[i] = uid, input
+	}
+
+	var failures []string
+	status := http.StatusAccepted
+	for i, event := range events {
+		err := addEventContext(r.Context(), h.Users, uids[i], inputs[i])
+		if err == nil {
+			continue
+		}
+
+		failures = append(failures, fmt.Sprintf("event %v: %v", event.Id, err))
+		var validationErr *EventValidationError
+		if !errors.As(err, &validationErr) {
+			status = http.StatusBadGateway
+		} else if status == http.StatusAccepted {
+			status = http.StatusBadRequest
+		}
+	}
+
+	if len(failures) > 0 {
+		http.Error(w, strings.Join(failures, "\n"), status)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
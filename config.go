@@ -1,14 +1,73 @@
 package goengage
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 type (
 	Config struct {
 		Credentials *Credentials
-		HTTPClient  *http.Client
+		// CredentialsProvider is used to look up credentials when Credentials is not set
+		CredentialsProvider CredentialsProvider
+		// CredentialsRefreshInterval is how long credentials from CredentialsProvider are cached. Defaults to
+		// 5 minutes; a negative value calls the provider on every request.
+		CredentialsRefreshInterval time.Duration
+		HTTPClient                 *http.Client
+		// MaxConcurrency caps the number of in-flight requests made by bulk operations. Defaults to 5.
+		MaxConcurrency int
+		// BaseUrl defaults to the engage.so v1 API
+		BaseUrl string
+		// UserAgent defaults to the library's user agent
+		UserAgent string
+		// Timeout is used for the default http client when HTTPClient is not set. Defaults to 10 seconds.
+		Timeout time.Duration
+		Retry   RetryPolicy
+		// RateLimit throttles requests on the client side. The zero value doesn't throttle.
+		RateLimit RateLimit
+		// Logger receives diagnostic messages such as retries. Nothing is logged when it is nil.
+		Logger Logger
+		// Cache enables the read-through cache of CachedUsers and CachedLists on the client's services when set
+		Cache *CacheOptions
+		// MaxResponseSize is the largest response body, in bytes, the client reads before failing with
+		// ErrResponseTooLarge. Defaults to 10 MiB.
+		MaxResponseSize int64
+		// GzipRequestThreshold gzips request bodies of at least this many bytes. 0 never compresses requests.
+		// Responses are always requested and decompressed as gzip.
+		GzipRequestThreshold int
+		// Events validates events sent with AddEvent against their declared schemas when set
+		Events *EventRegistry
+		// Dedup skips events whose IdempotencyKey was sent recently when set
+		Dedup DedupStore
+	}
+
+	// Logger is satisfied by *log.Logger
+	Logger interface {
+		Printf(format string, v ...interface{})
+	}
+
+	// RetryPolicy retries rate limited requests, and server errors or network failures of idempotent requests.
+	// The zero value doesn't retry.
+	RetryPolicy struct {
+		MaxRetries int
+		// MinBackoff is the delay before the first retry. It doubles on every retry up to MaxBackoff. A longer
+		// Retry-After sent by the API takes precedence.
+		MinBackoff time.Duration
+		MaxBackoff time.Duration
+	}
+
+	RateLimit struct {
+		RequestsPerSecond float64
+		// Burst is the number of requests that can be made at once before being throttled. Defaults to 1.
+		Burst int
 	}
 )
 
@@ -29,15 +88,155 @@ func (c *Config) WithCredentials(credentials *Credentials) *Config {
 	return c
 }
 
+// WithCredentialsProvider sets the provider used to look up credentials, e.g. a ChainProvider
+func (c *Config) WithCredentialsProvider(provider CredentialsProvider) *Config {
+	c.CredentialsProvider = provider
+	return c
+}
+
+// WithCredentialsRefreshInterval sets how long credentials from the credentials provider are cached
+func (c *Config) WithCredentialsRefreshInterval(interval time.Duration) *Config {
+	c.CredentialsRefreshInterval = interval
+	return c
+}
+
+// WithMaxConcurrency sets the maximum number of concurrent requests bulk operations can make
+func (c *Config) WithMaxConcurrency(n int) *Config {
+	c.MaxConcurrency = n
+	return c
+}
+
+// WithBaseUrl sets the API base url requests are sent to
+func (c *Config) WithBaseUrl(baseUrl string) *Config {
+	c.BaseUrl = baseUrl
+	return c
+}
+
+// WithUserAgent sets the User-Agent header sent with requests
+func (c *Config) WithUserAgent(userAgent string) *Config {
+	c.UserAgent = userAgent
+	return c
+}
+
+// WithTimeout sets the timeout of the default http client
+func (c *Config) WithTimeout(timeout time.Duration) *Config {
+	c.Timeout = timeout
+	return c
+}
+
+// WithRetry sets the policy used to retry failed requests
+func (c *Config) WithRetry(policy RetryPolicy) *Config {
+	c.Retry = policy
+	return c
+}
+
+// WithRateLimit sets the client side rate limit
+func (c *Config) WithRateLimit(limit RateLimit) *Config {
+	c.RateLimit = limit
+	return c
+}
+
+// WithLogger sets the logger receiving diagnostic messages
+func (c *Config) WithLogger(logger Logger) *Config {
+	c.Logger = logger
+	return c
+}
+
+// WithMaxResponseSize sets the largest response body the client accepts
+func (c *Config) WithMaxResponseSize(size int64) *Config {
+	c.MaxResponseSize = size
+	return c
+}
+
+// WithGzipRequestThreshold gzips request bodies of at least threshold bytes
+func (c *Config) WithGzipRequestThreshold(threshold int) *Config {
+	c.GzipRequestThreshold = threshold
+	return c
+}
+
+// WithCache enables caching of Users.Get and Lists.GetList
+func (c *Config) WithCache(options CacheOptions) *Config {
+	c.Cache = &options
+	return c
+}
+
+// WithEventRegistry validates events against registry before they are sent
+func (c *Config) WithEventRegistry(registry *EventRegistry) *Config {
+	c.Events = registry
+	return c
+}
+
+// WithDedup skips events whose idempotency key is already in store
+func (c *Config) WithDedup(store DedupStore) *Config {
+	c.Dedup = store
+	return c
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
 type (
 	Credentials struct {
 		publicKey  string
 		privateKey string
+		source     string
+	}
+
+	// CredentialsProvider looks up API credentials from a source such as the environment or a file.
+	// Credentials are themselves a provider that always returns itself.
+	CredentialsProvider interface {
+		Retrieve() (*Credentials, error)
+	}
+
+	// EnvProvider reads credentials from ENGAGE_SO_PUBLIC_KEY and ENGAGE_SO_PRIVATE_KEY every time it is called
+	EnvProvider struct{}
+
+	// FileProvider reads credentials from a profile of an INI style credentials file:
+	//
+	//	[default]
+	//	public_key = your_public_key
+	//	private_key = your_private_key
+	//
+	// Filename defaults to ENGAGE_SO_CREDENTIALS_FILE or ~/.engage/credentials, and Profile defaults to
+	// ENGAGE_SO_PROFILE or "default".
+	FileProvider struct {
+		Filename string
+		Profile  string
+	}
+
+	// ChainProvider returns the credentials of the first provider that succeeds
+	ChainProvider struct {
+		Providers []CredentialsProvider
+	}
+
+	// CachedProvider caches the credentials of another provider and refreshes them once they are older than the
+	// refresh interval. If a refresh fails, the previous credentials keep being served until a refresh succeeds.
+	CachedProvider struct {
+		provider  CredentialsProvider
+		interval  time.Duration
+		mu        sync.Mutex
+		cached    *Credentials
+		fetchedAt time.Time
+	}
+
+	// FileWatcherProvider serves credentials from a credentials file and reloads them when the file changes.
+	// The file is checked at most once per poll interval. New keys are swapped in as a whole, so a request never mixes
+	// an old public key with a new private key, and a file caught mid-write keeps the previous keys in use.
+	FileWatcherProvider struct {
+		file         *FileProvider
+		pollInterval time.Duration
+		mu           sync.Mutex
+		current      *Credentials
+		checkedAt    time.Time
+		modTime      time.Time
+		size         int64
 	}
 )
 
+const (
+	defaultProfile         string = "default"
+	defaultCredentialsFile string = ".engage/credentials"
+)
+
 // NewEnvCredentials reads and sets the API key and secret from runtime environment variables.
 // It looks for ENGAGE_SO_PUBLIC_KEY and ENGAGE_SO_PRIVATE_KEY.
 // The os env lookup sets blank string if the keys are not found.
@@ -45,6 +244,7 @@ func NewEnvCredentials() *Credentials {
 	return &Credentials{
 		publicKey:  os.Getenv("ENGAGE_SO_PUBLIC_KEY"),
 		privateKey: os.Getenv("ENGAGE_SO_PRIVATE_KEY"),
+		source:     "env",
 	}
 }
 
@@ -53,5 +253,257 @@ func NewStaticCredentials(publicKey, privateKey string) *Credentials {
 	return &Credentials{
 		publicKey:  publicKey,
 		privateKey: privateKey,
+		source:     "static",
+	}
+}
+
+// Source returns the name of the source the credentials were read from, e.g. "env", "static" or "file:<path>"
+func (c *Credentials) Source() string {
+	return c.source
+}
+
+// Retrieve returns the credentials if both keys are set
+func (c *Credentials) Retrieve() (*Credentials, error) {
+	if c.publicKey == "" {
+		return nil, fmt.Errorf("%v: public key is required", c.source)
+	}
+
+	if c.privateKey == "" {
+		return nil, fmt.Errorf("%v: private key is required", c.source)
+	}
+	return c, nil
+}
+
+// NewEnvProvider returns a provider reading credentials from environment variables on each call
+func NewEnvProvider() *EnvProvider {
+	return &EnvProvider{}
+}
+
+func (p *EnvProvider) Retrieve() (*Credentials, error) {
+	return NewEnvCredentials().Retrieve()
+}
+
+// NewFileProvider returns a provider reading the given profile of a credentials file.
+// Blank arguments fall back to the defaults described on FileProvider.
+func NewFileProvider(filename, profile string) *FileProvider {
+	return &FileProvider{
+		Filename: filename,
+		Profile:  profile,
+	}
+}
+
+func (p *FileProvider) Retrieve() (*Credentials, error) {
+	filename, err := p.filename()
+	if err != nil {
+		return nil, fmt.Errorf("file: %w", err)
+	}
+
+	profile := p.profile()
+	source := fmt.Sprintf("file:%v", filename)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", source, err)
+	}
+	defer f.Close()
+
+	credentials, err := parseCredentialsFile(f, profile)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", source, err)
+	}
+
+	credentials.source = source
+	return credentials.Retrieve()
+}
+
+func (p *FileProvider) filename() (string, error) {
+	if p.Filename != "" {
+		return p.Filename, nil
+	}
+
+	if filename := os.Getenv("ENGAGE_SO_CREDENTIALS_FILE"); filename != "" {
+		return filename, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, defaultCredentialsFile), nil
+}
+
+func (p *FileProvider) profile() string {
+	if p.Profile != "" {
+		return p.Profile
+	}
+
+	if profile := os.Getenv("ENGAGE_SO_PROFILE"); profile != "" {
+		return profile
+	}
+	return defaultProfile
+}
+
+// parseCredentialsFile reads the keys of profile from an INI style file. Lines starting with # or ; are comments.
+func parseCredentialsFile(r io.Reader, profile string) (*Credentials, error) {
+	var (
+		current     string
+		found       bool
+		credentials = &Credentials{}
+		scanner     = bufio.NewScanner(r)
+	)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			found = found || current == profile
+			continue
+		}
+
+		if current != profile {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch strings.TrimSpace(parts[0]) {
+		case "public_key":
+			credentials.publicKey = strings.TrimSpace(parts[1])
+		case "private_key":
+			credentials.privateKey = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, fmt.Errorf("profile %q not found", profile)
+	}
+	return credentials, nil
+}
+
+// NewChainProvider returns a provider trying each of the given providers in order, e.g.
+//
+//	NewChainProvider(NewEnvProvider(), NewFileProvider("", ""), NewStaticCredentials("public_key", "private_key"))
+func NewChainProvider(providers ...CredentialsProvider) *ChainProvider {
+	return &ChainProvider{
+		Providers: providers,
+	}
+}
+
+// Retrieve returns the credentials of the first provider that succeeds. Use Credentials.Source to know which one won.
+// If none succeeds, the error lists why each provider failed.
+func (p *ChainProvider) Retrieve() (*Credentials, error) {
+	if len(p.Providers) == 0 {
+		return nil, errors.New("chain: no credentials providers configured")
+	}
+
+	var failures []string
+	for _, provider := range p.Providers {
+		credentials, err := provider.Retrieve()
+		if err == nil {
+			return credentials, nil
+		}
+		failures = append(failures, err.Error())
+	}
+
+	return nil, fmt.Errorf("no valid credentials found, tried: %v", strings.Join(failures, "; "))
+}
+
+// NewCachedProvider wraps provider so it is called at most once per interval
+func NewCachedProvider(provider CredentialsProvider, interval time.Duration) *CachedProvider {
+	return &CachedProvider{
+		provider: provider,
+		interval: interval,
+	}
+}
+
+func (p *CachedProvider) Retrieve() (*Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cached != nil && time.Since(p.fetchedAt) < p.interval {
+		return p.cached, nil
+	}
+
+	credentials, err := p.provider.Retrieve()
+	if err != nil {
+		if p.cached != nil {
+			return p.cached, nil
+		}
+		return nil, err
+	}
+
+	p.cached = credentials
+	p.fetchedAt = time.Now()
+	return credentials, nil
+}
+
+// Expire forces the next Retrieve to call the wrapped provider
+func (p *CachedProvider) Expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.fetchedAt = time.Time{}
+}
+
+// NewFileWatcherProvider returns a provider that reloads the given profile of a credentials file whenever the file
+// changes. Blank arguments fall back to the defaults described on FileProvider.
+func NewFileWatcherProvider(filename, profile string, pollInterval time.Duration) *FileWatcherProvider {
+	return &FileWatcherProvider{
+		file:         NewFileProvider(filename, profile),
+		pollInterval: pollInterval,
+	}
+}
+
+func (p *FileWatcherProvider) Retrieve() (*Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := p.current
+	if current != nil && time.Since(p.checkedAt) < p.pollInterval {
+		return current, nil
+	}
+	p.checkedAt = time.Now()
+
+	filename, err := p.file.filename()
+	if err != nil {
+		return p.fallback(current, fmt.Errorf("file: %w", err))
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return p.fallback(current, fmt.Errorf("file:%v: %w", filename, err))
+	}
+
+	if current != nil && info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return current, nil
+	}
+
+	credentials, err := p.file.Retrieve()
+	if err != nil {
+		return p.fallback(current, err)
+	}
+
+	p.modTime = info.ModTime()
+	p.size = info.Size()
+	p.current = credentials
+	return credentials, nil
+}
+
+// fallback keeps serving the last good credentials when reloading fails
+func (p *FileWatcherProvider) fallback(current *Credentials, err error) (*Credentials, error) {
+	if current != nil {
+		return current, nil
 	}
+	return nil, err
 }
@@ -0,0 +1,266 @@
+package goengage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// ConfigError lists every problem found while loading a config
+	ConfigError struct {
+		Problems []string
+	}
+
+	// fileConfig is the layout of config files. Durations are strings parsed by time.ParseDuration, e.g. "10s".
+	fileConfig struct {
+		BaseUrl        string                `json:"base_url" yaml:"base_url"`
+		UserAgent      string                `json:"user_agent" yaml:"user_agent"`
+		Timeout        string                `json:"timeout" yaml:"timeout"`
+		MaxConcurrency int                   `json:"max_concurrency" yaml:"max_concurrency"`
+		GzipThreshold  int                   `json:"gzip_request_threshold" yaml:"gzip_request_threshold"`
+		Retry          fileRetryPolicy       `json:"retry" yaml:"retry"`
+		RateLimit      fileRateLimit         `json:"rate_limit" yaml:"rate_limit"`
+		Credentials    fileCredentialsSource `json:"credentials" yaml:"credentials"`
+	}
+
+	fileRetryPolicy struct {
+		MaxRetries int    `json:"max_retries" yaml:"max_retries"`
+		MinBackoff string `json:"min_backoff" yaml:"min_backoff"`
+		MaxBackoff string `json:"max_backoff" yaml:"max_backoff"`
+	}
+
+	fileRateLimit struct {
+		RequestsPerSecond float64 `json:"requests_per_second" yaml:"requests_per_second"`
+		Burst             int     `json:"burst" yaml:"burst"`
+	}
+
+	fileCredentialsSource struct {
+		// Source is one of env, file, static or chain. Defaults to chain.
+		Source          string `json:"source" yaml:"source"`
+		File            string `json:"file" yaml:"file"`
+		Profile         string `json:"profile" yaml:"profile"`
+		PublicKey       string `json:"public_key" yaml:"public_key"`
+		PrivateKey      string `json:"private_key" yaml:"private_key"`
+		RefreshInterval string `json:"refresh_interval" yaml:"refresh_interval"`
+	}
+)
+
+// LoadConfig reads a YAML or JSON config file and applies environment variable overrides on top of it.
+// Files ending in .json are read as JSON, anything else as YAML:
+//
+//	base_url: https://api.engage.so/v1
+//	user_agent: my-service
+//	timeout: 10s
+//	max_concurrency: 5
+//	gzip_request_threshold: 4096
+//	retry:
+//	  max_retries: 3
+//	  min_backoff: 500ms
+//	  max_backoff: 5s
+//	rate_limit:
+//	  requests_per_second: 10
+//	  burst: 5
+//	credentials:
+//	  source: chain # env, file, static or chain
+//	  file: ~/.engage/credentials
+//	  profile: default
+//	  refresh_interval: 5m
+//
+// The following environment variables override the file: ENGAGE_SO_BASE_URL, ENGAGE_SO_USER_AGENT,
+// ENGAGE_SO_TIMEOUT, ENGAGE_SO_MAX_RETRIES, ENGAGE_SO_RATE_LIMIT and ENGAGE_SO_CREDENTIALS_SOURCE. An empty path
+// only reads the environment. Every problem found is reported together in a *ConfigError.
+func LoadConfig(path string) (*Config, error) {
+	var fc fileConfig
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("goengage: %w", err)
+		}
+
+		if err := decodeConfigFile(path, content, &fc); err != nil {
+			return nil, &ConfigError{Problems: []string{fmt.Sprintf("%v: %v", path, err)}}
+		}
+	}
+
+	var problems []string
+	fc.applyEnv(&problems)
+
+	config := fc.config(&problems)
+	if len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
+	return config, nil
+}
+
+func decodeConfigFile(path string, content []byte, fc *fileConfig) error {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(fc)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(fc); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func (fc *fileConfig) applyEnv(problems *[]string) {
+	if v := os.Getenv("ENGAGE_SO_BASE_URL"); v != "" {
+		fc.BaseUrl = v
+	}
+
+	if v := os.Getenv("ENGAGE_SO_USER_AGENT"); v != "" {
+		fc.UserAgent = v
+	}
+
+	if v := os.Getenv("ENGAGE_SO_TIMEOUT"); v != "" {
+		fc.Timeout = v
+	}
+
+	if v := os.Getenv("ENGAGE_SO_MAX_RETRIES"); v != "" {
+		retries, err := strconv.Atoi(v)
+		if err != nil {
+			*problems = append(*problems, fmt.Sprintf("ENGAGE_SO_MAX_RETRIES: %q is not a number", v))
+		}
+		fc.Retry.MaxRetries = retries
+	}
+
+	if v := os.Getenv("ENGAGE_SO_RATE_LIMIT"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			*problems = append(*problems, fmt.Sprintf("ENGAGE_SO_RATE_LIMIT: %q is not a number", v))
+		}
+		fc.RateLimit.RequestsPerSecond = rate
+	}
+
+	if v := os.Getenv("ENGAGE_SO_CREDENTIALS_SOURCE"); v != "" {
+		fc.Credentials.Source = v
+	}
+}
+
+// config validates the file config and converts it, appending every problem found
+func (fc *fileConfig) config(problems *[]string) *Config {
+	report := func(format string, args ...interface{}) {
+		*problems = append(*problems, fmt.Sprintf(format, args...))
+	}
+
+	duration := func(field, value string) time.Duration {
+		if value == "" {
+			return 0
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			report("%v: %q is not a valid duration", field, value)
+			return 0
+		}
+		if d < 0 {
+			report("%v: must not be negative", field)
+		}
+		return d
+	}
+
+	config := NewConfig()
+	config.UserAgent = fc.UserAgent
+	config.Timeout = duration("timeout", fc.Timeout)
+	config.Retry = RetryPolicy{
+		MaxRetries: fc.Retry.MaxRetries,
+		MinBackoff: duration("retry.min_backoff", fc.Retry.MinBackoff),
+		MaxBackoff: duration("retry.max_backoff", fc.Retry.MaxBackoff),
+	}
+	config.RateLimit = RateLimit{
+		RequestsPerSecond: fc.RateLimit.RequestsPerSecond,
+		Burst:             fc.RateLimit.Burst,
+	}
+	config.MaxConcurrency = fc.MaxConcurrency
+	config.GzipRequestThreshold = fc.GzipThreshold
+	config.CredentialsRefreshInterval = duration("credentials.refresh_interval", fc.Credentials.RefreshInterval)
+
+	if fc.BaseUrl != "" {
+		u, err := url.Parse(fc.BaseUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			report("base_url: %q is not an absolute http(s) url", fc.BaseUrl)
+		}
+		config.BaseUrl = fc.BaseUrl
+	}
+
+	if fc.MaxConcurrency < 0 {
+		report("max_concurrency: must not be negative")
+	}
+
+	if fc.GzipThreshold < 0 {
+		report("gzip_request_threshold: must not be negative")
+	}
+
+	if fc.Retry.MaxRetries < 0 {
+		report("retry.max_retries: must not be negative")
+	}
+
+	if config.Retry.MaxBackoff > 0 && config.Retry.MinBackoff > config.Retry.MaxBackoff {
+		report("retry.min_backoff: must not be greater than retry.max_backoff")
+	}
+
+	if fc.RateLimit.RequestsPerSecond < 0 {
+		report("rate_limit.requests_per_second: must not be negative")
+	}
+
+	if fc.RateLimit.Burst < 0 {
+		report("rate_limit.burst: must not be negative")
+	}
+
+	creds := fc.Credentials
+	file := expandHome(creds.File)
+	static := NewStaticCredentials(creds.PublicKey, creds.PrivateKey)
+	switch creds.Source {
+	case "env":
+		config.CredentialsProvider = NewEnvProvider()
+	case "file":
+		config.CredentialsProvider = NewFileProvider(file, creds.Profile)
+	case "static":
+		if creds.PublicKey == "" || creds.PrivateKey == "" {
+			report("credentials: public_key and private_key are required for the static source")
+		}
+		config.CredentialsProvider = static
+	case "", "chain":
+		providers := []CredentialsProvider{NewEnvProvider(), NewFileProvider(file, creds.Profile)}
+		if creds.PublicKey != "" || creds.PrivateKey != "" {
+			providers = append(providers, static)
+		}
+		config.CredentialsProvider = NewChainProvider(providers...)
+	default:
+		report("credentials.source: %q must be one of env, file, static or chain", creds.Source)
+	}
+
+	return config
+}
+
+// expandHome replaces a leading ~ with the user's home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("goengage: invalid config: %v", strings.Join(e.Problems, "; "))
+}
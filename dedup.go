@@ -0,0 +1,248 @@
+package goengage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupWindow time.Duration = 24 * time.Hour
+	// minDedupCompactLines is the number of lines a FileDedupStore appends before it is first compacted
+	minDedupCompactLines int = 1000
+)
+
+// ErrEventInFlight is returned for an event whose idempotency key is already being sent by another call. The event
+// wasn't sent; retry it once the other call is done.
+var ErrEventInFlight = errors.New("goengage: an event with the same idempotency key is being sent")
+
+type (
+	// DedupStore remembers the idempotency keys of events sent recently. When Config.Dedup is set, AddEvent and
+	// AddEvents skip events whose IdempotencyKey was sent within the store's window. Keys are only committed once
+	// their event was accepted by the API, so an event that failed, or whose sender crashed, can be sent again.
+	DedupStore interface {
+		// Seen reports whether key was committed within the window
+		Seen(key string) (bool, error)
+		// Commit records that the event of key was sent
+		Commit(key string) error
+	}
+
+	// MemoryDedupStore keeps keys in an in-memory LRU. The least recently committed key is dropped once Size keys are
+	// held, even if its window hasn't passed.
+	MemoryDedupStore struct {
+		cache *lruCache
+	}
+
+	// FileDedupStore keeps keys in a file so they survive restarts. Every commit is appended to the file, which is
+	// compacted when it is opened and whenever it holds twice as many lines as keys within the window. Only one
+	// process should use a file at a time.
+	FileDedupStore struct {
+		mu       sync.Mutex
+		filename string
+		file     *os.File
+		window   time.Duration
+		keys     map[string]time.Time
+		// lines is the number of lines in the file, and compactAt the number at which it is compacted next
+		lines     int
+		compactAt int
+		now       func() time.Time
+	}
+)
+
+// NewMemoryDedupStore returns a store remembering up to size keys for window. size defaults to 1000 and window to
+// 24 hours.
+func NewMemoryDedupStore(size int, window time.Duration) *MemoryDedupStore {
+	if window <= 0 {
+		window = defaultDedupWindow
+	}
+	return &MemoryDedupStore{cache: newLruCache(CacheOptions{Size: size, TTL: window})}
+}
+
+func (s *MemoryDedupStore) Seen(key string) (bool, error) {
+	return s.cache.contains(key), nil
+}
+
+func (s *MemoryDedupStore) Commit(key string) error {
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+	s.cache.set(key, struct{}{})
+	return nil
+}
+
+// NewFileDedupStore opens or creates the store at filename, remembering keys for window. window defaults to 24 hours.
+func NewFileDedupStore(filename string, window time.Duration) (*FileDedupStore, error) {
+	if window <= 0 {
+		window = defaultDedupWindow
+	}
+
+	s := &FileDedupStore{filename: filename, window: window, keys: map[string]time.Time{}, now: time.Now}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileDedupStore) Seen(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	committed, ok := s.keys[key]
+	return ok && s.now().Sub(committed) < s.window, nil
+}
+
+func (s *FileDedupStore) Commit(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if err := s.append(key, now); err != nil {
+		return err
+	}
+	s.keys[key] = now
+
+	if s.lines >= s.compactAt {
+		return s.compact()
+	}
+	return nil
+}
+
+// Close closes the underlying file
+func (s *FileDedupStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// load reads the commits of the file, a line per commit made of the Unix time in nanoseconds and the key
+func (s *FileDedupStore) load() error {
+	file, err := os.Open(s.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("goengage: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		nanos, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		key, err := strconv.Unquote(parts[1])
+		if err != nil {
+			continue
+		}
+		s.keys[key] = time.Unix(0, nanos)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("goengage: unable to read %v: %w", s.filename, err)
+	}
+	return nil
+}
+
+// compact drops the keys past the window and rewrites the file with the others, keeping it open for appending
+func (s *FileDedupStore) compact() error {
+	now := s.now()
+	for key, committed := range s.keys {
+		if now.Sub(committed) >= s.window {
+			delete(s.keys, key)
+		}
+	}
+
+	tmp := s.filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("goengage: %w", err)
+	}
+
+	previous := s.file
+	s.file, s.lines = file, 0
+	for key, committed := range s.keys {
+		if err := s.append(key, committed); err != nil {
+			file.Close()
+			s.file = previous
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, s.filename); err != nil {
+		file.Close()
+		s.file = previous
+		return fmt.Errorf("goengage: %w", err)
+	}
+
+	if previous != nil {
+		previous.Close()
+	}
+
+	s.compactAt = 2 * len(s.keys)
+	if s.compactAt < minDedupCompactLines {
+		s.compactAt = minDedupCompactLines
+	}
+	return nil
+}
+
+func (s *FileDedupStore) append(key string, committed time.Time) error {
+	// Keys are quoted to keep them on a single line
+	if _, err := fmt.Fprintf(s.file, "%d %q\n", committed.UnixNano(), key); err != nil {
+		return fmt.Errorf("goengage: %w", err)
+	}
+	s.lines++
+	return nil
+}
+
+// beginEvent checks the idempotency key of event before it is sent. It returns true when the event is a duplicate to
+// skip, and ErrEventInFlight when another call is sending an event with the same key. Otherwise the key is marked as
+// in flight, in memory only, until endEvent is called.
+func (c *Client) beginEvent(event *AddUserEvent) (bool, error) {
+	if c.dedup == nil || event.IdempotencyKey == "" {
+		return false, nil
+	}
+
+	key := event.IdempotencyKey
+	if _, inFlight := c.inflight.LoadOrStore(key, struct{}{}); inFlight {
+		return false, ErrEventInFlight
+	}
+
+	duplicate, err := c.dedup.Seen(key)
+	if err != nil || duplicate {
+		c.inflight.Delete(key)
+	}
+	if duplicate {
+		c.logf("goengage: skipping event %v with duplicate idempotency key %q", event.Event, key)
+	}
+	return duplicate, err
+}
+
+// endEvent commits the idempotency key of an event that was sent, and lets other calls send events with the key
+func (c *Client) endEvent(event *AddUserEvent, sent bool) {
+	if c.dedup == nil || event.IdempotencyKey == "" {
+		return
+	}
+	defer c.inflight.Delete(event.IdempotencyKey)
+
+	if !sent {
+		return
+	}
+	if err := c.dedup.Commit(event.IdempotencyKey); err != nil {
+		c.logf("goengage: unable to commit idempotency key %q: %v", event.IdempotencyKey, err)
+	}
+}
@@ -5,18 +5,28 @@
 package goengage
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// errNotModified is returned for 304 responses to conditional requests
+var errNotModified = errors.New("goengage: not modified")
+
 const (
-	userAgent string = "Heroshe - GoEngage Lib"
-	apiUrl    string = "https://api.engage.so/v1"
+	userAgent                         string        = "Heroshe - GoEngage Lib"
+	apiUrl                            string        = "https://api.engage.so/v1"
+	defaultMaxConcurrency             int           = 5
+	defaultTimeout                    time.Duration = 10 * time.Second
+	defaultCredentialsRefreshInterval time.Duration = 5 * time.Minute
 )
 
 type (
@@ -25,100 +35,318 @@ type (
 	}
 
 	Client struct {
-		httpClient   *http.Client
-		BaseUrl      string
-		UserAgent    string
-		credentials  *Credentials
+		httpClient           *http.Client
+		BaseUrl              string
+		UserAgent            string
+		credentials          CredentialsProvider
+		maxConcurrency       int
+		retry                RetryPolicy
+		limiter              *rateLimiter
+		logger               Logger
+		maxResponseSize      int64
+		gzipRequestThreshold int
+		events               *EventRegistry
+		// batchUnsupportedUntil is when to try batched events again after the API didn't know them, in Unix
+		// nanoseconds, see Users.AddEvents
+		batchUnsupportedUntil int64
+		dedup                 DedupStore
+		// inflight holds the idempotency keys of the events being sent, see beginEvent
+		inflight     sync.Map
 		commonClient service
 
 		Users UserService
 		Lists ListService
 	}
 
+	// ConflictError is returned when an update sent with an If-Match precondition was rejected because the resource
+	// changed since it was read. Read the resource again to get its current ETag before retrying.
+	ConflictError struct {
+		Err Error
+	}
+
 	Error struct {
 		Code    int
 		Message string
+		// RetryAfter is how long the API asked us to wait before retrying. It is only set on rate limited responses.
+		RetryAfter time.Duration
 	}
 )
 
+// New creates a client from config. The config and the values it points to are not modified, so it can be reused.
 func New(config *Config) (*Client, error) {
-	if err := validateConfig(config); err != nil {
+	if config == nil {
+		return nil, errors.New("goengage: config is required")
+	}
+
+	credentials, err := validateConfig(config)
+	if err != nil {
 		return nil, err
 	}
 
-	if config.HTTPClient == nil {
-		config.HTTPClient = &http.Client{
-			Timeout: 10 * time.Second,
-		}
+	maxConcurrency := config.MaxConcurrency
+	if maxConcurrency <= 0 {
+		maxConcurrency = defaultMaxConcurrency
 	}
 
 	c := &Client{
-		BaseUrl:     apiUrl,
-		credentials: config.Credentials,
-		httpClient:  config.HTTPClient,
-		UserAgent:   userAgent,
+		BaseUrl:              apiUrl,
+		credentials:          credentials,
+		httpClient:           httpClientFor(config),
+		UserAgent:            userAgent,
+		maxConcurrency:       maxConcurrency,
+		retry:                config.Retry,
+		limiter:              newRateLimiter(config.RateLimit),
+		logger:               config.Logger,
+		maxResponseSize:      config.MaxResponseSize,
+		gzipRequestThreshold: config.GzipRequestThreshold,
+		events:               config.Events,
+		dedup:                config.Dedup,
+	}
+	if c.maxResponseSize <= 0 {
+		c.maxResponseSize = defaultMaxResponseSize
+	}
+	if config.BaseUrl != "" {
+		c.BaseUrl = strings.TrimSuffix(config.BaseUrl, "/")
+	}
+	if config.UserAgent != "" {
+		c.UserAgent = config.UserAgent
 	}
 	c.commonClient.client = c
 	c.Users = (*Users)(&c.commonClient)
 	c.Lists = (*Lists)(&c.commonClient)
+	if config.Cache != nil {
+		users := NewCachedUserService(c.Users, *config.Cache)
+		lists := NewCachedListService(c.Lists, *config.Cache)
+		lists.Users = users
+		c.Users, c.Lists = users, lists
+	}
 	return c, nil
 }
 
-func (c *Client) newRequest(method, endpoint string, body io.Reader) (*http.Request, error) {
+// httpClientFor returns the http client described by config. A caller provided client is copied rather than modified
+// when Config.Timeout has to be applied to it; the copy shares the original transport and connection pool.
+func httpClientFor(config *Config) *http.Client {
+	if config.HTTPClient == nil {
+		timeout := config.Timeout
+		if timeout == 0 {
+			timeout = defaultTimeout
+		}
+		return &http.Client{
+			Timeout: timeout,
+		}
+	}
+
+	if config.Timeout == 0 || config.Timeout == config.HTTPClient.Timeout {
+		return config.HTTPClient
+	}
+
+	httpClient := *config.HTTPClient
+	httpClient.Timeout = config.Timeout
+	return &httpClient
+}
+
+func (c *Client) newRequest(method, endpoint string, body *requestBody) (*http.Request, error) {
+	return c.newRequestWithContext(context.Background(), method, endpoint, body)
+}
+
+func (c *Client) newRequestWithContext(ctx context.Context, method, endpoint string, body *requestBody) (*http.Request, error) {
 	url := fmt.Sprintf("%v/%v", c.BaseUrl, endpoint)
 	if strings.HasPrefix(endpoint, "/") {
 		url = fmt.Sprintf("%v%v", c.BaseUrl, endpoint)
 	}
 
-	req, err := http.NewRequest(method, url, body)
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	req.SetBasicAuth(c.credentials.publicKey, c.credentials.privateKey)
+	if body != nil {
+		if c.gzipRequestThreshold > 0 && body.len() >= int64(c.gzipRequestThreshold) {
+			if err := body.compress(); err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+
+		req.Body = body.reader()
+		req.ContentLength = body.len()
+		req.GetBody = func() (io.ReadCloser, error) {
+			return body.reader(), nil
+		}
+	}
+
+	credentials, err := c.credentials.Retrieve()
+	if err != nil {
+		return nil, fmt.Errorf("goengage: %w", err)
+	}
+
+	req.SetBasicAuth(credentials.publicKey, credentials.privateKey)
 	req.Header.Set("User-Agent", c.UserAgent)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
+	// Setting Accept-Encoding ourselves turns off the transport's transparent decompression, so responses are
+	// decompressed the same way whether or not the http client's transport disables compression.
+	req.Header.Set("Accept-Encoding", "gzip")
 
 	return req, nil
 }
 
+// setConditionalHeaders makes req conditional on the resource having changed since the given validators were read
+func setConditionalHeaders(req *http.Request, etag, lastModified string) {
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// makeRequest sends the request, retrying it according to the client's retry policy, and decodes a successful
+// response into target.
 func (c *Client) makeRequest(req *http.Request, target interface{}) error {
+	_, err := c.sendRequest(req, target)
+	return err
+}
+
+// sendRequest behaves like makeRequest and also returns the headers of the final response
+func (c *Client) sendRequest(req *http.Request, target interface{}) (http.Header, error) {
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.wait(req.Context()); err != nil {
+			return nil, err
+		}
+
+		header, err := c.doRequest(req, target)
+		c.limiter.pause(err)
+		if err == nil || attempt >= c.maxRetries(req, err) || !shouldRetry(req, err) {
+			return header, err
+		}
+
+		delay := c.retry.backoff(attempt, err)
+		c.logf("goengage: retrying %v %v in %v: %v", req.Method, req.URL.Path, delay, err)
+		if err := sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) doRequest(req *http.Request, target interface{}) (http.Header, error) {
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	if resp.ContentLength > c.maxResponseSize {
+		return resp.Header, ErrResponseTooLarge
+	}
+
+	// Drain what's left of the body so the connection can be reused
+	defer io.Copy(ioutil.Discard, io.LimitReader(resp.Body, c.maxResponseSize))
+
+	if resp.StatusCode == http.StatusNotModified {
+		return resp.Header, errNotModified
+	}
+
+	reader, length, err := decompress(resp)
 	if err != nil {
-		return err
+		return resp.Header, err
 	}
+	defer reader.Close()
 
-	successCodes := []int{
-		200, 201, 202, 203, 204, 205, 206,
+	// The size guard applies to the decompressed body so a small gzip payload can't expand without bounds
+	body := &limitedReader{r: reader, remaining: c.maxResponseSize}
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 206 {
+		return resp.Header, decode(body, length, target)
 	}
-	for _, code := range successCodes {
-		if code == resp.StatusCode {
-			return json.Unmarshal(body, target)
-		}
+
+	message, err := ioutil.ReadAll(body)
+	if err != nil {
+		return resp.Header, err
 	}
 
-	return Error{
-		Code:    resp.StatusCode,
-		Message: string(body),
+	apiErr := Error{
+		Code:       resp.StatusCode,
+		Message:    string(message),
+		RetryAfter: retryAfter(resp),
 	}
+
+	if req.Header.Get("If-Match") != "" &&
+		(resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict) {
+		return resp.Header, &ConflictError{Err: apiErr}
+	}
+
+	return resp.Header, apiErr
 }
 
-func validateConfig(config *Config) error {
-	if config.Credentials.publicKey == "" {
-		return fmt.Errorf("goengage: Public Key is required")
+func (c *Client) logf(format string, v ...interface{}) {
+	if c.logger != nil {
+		c.logger.Printf(format, v...)
+	}
+}
+
+// retryAfter reads the Retry-After header of a rate limited response. Only the delay-seconds form is supported.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// validateConfig checks the config and returns the credentials provider the client should call on each request.
+// Providers that don't manage their own refreshing are cached for Config.CredentialsRefreshInterval.
+func validateConfig(config *Config) (CredentialsProvider, error) {
+	var provider CredentialsProvider
+	switch {
+	case config.Credentials != nil:
+		provider = config.Credentials
+	case isNilProvider(config.CredentialsProvider):
+		return nil, errors.New("goengage: CredentialsProvider is a nil pointer")
+	case config.CredentialsProvider != nil:
+		provider = cachedProvider(config.CredentialsProvider, config.CredentialsRefreshInterval)
+	default:
+		return nil, errors.New("goengage: Credentials or a CredentialsProvider is required")
 	}
 
-	if config.Credentials.privateKey == "" {
-		return fmt.Errorf("goengage: Private Key is required")
+	if _, err := provider.Retrieve(); err != nil {
+		return nil, fmt.Errorf("goengage: %w", err)
 	}
-	return nil
+	return provider, nil
+}
+
+// isNilProvider reports whether provider holds a nil pointer, such as a (*Credentials)(nil), which isn't nil itself
+func isNilProvider(provider CredentialsProvider) bool {
+	v := reflect.ValueOf(provider)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+func cachedProvider(provider CredentialsProvider, interval time.Duration) CredentialsProvider {
+	switch provider.(type) {
+	case *Credentials, *CachedProvider, *FileWatcherProvider:
+		return provider
+	}
+
+	if interval == 0 {
+		interval = defaultCredentialsRefreshInterval
+	}
+	return NewCachedProvider(provider, interval)
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Go Engage Conflict - the resource was modified: %v", e.Err)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
 }
 
 func (e Error) Error() string {
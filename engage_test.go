@@ -1,12 +1,24 @@
 package goengage
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -25,11 +37,11 @@ var (
 		Devices: []UserDevice{
 			{
 				Token:    "QWERTYUIOP",
-				Platform: "ANDROID",
+				Platform: DevicePlatformAndroid,
 			},
 			{
 				Token:    "ASDFGHJKL",
-				Platform: "APPLE",
+				Platform: DevicePlatformIos,
 			},
 		},
 		Lists: []UserList{
@@ -137,13 +149,55 @@ func TestUsers_List(t *testing.T) {
 func TestUsers_UpdateAttributes(t *testing.T) {
 	assert.NotPanics(t, func() {
 		user, err := client.Users.UpdateAttributes(fakeUser.Uid, &UpdateUserAttributesInput{
-			Number: String("1234567890"),
+			Number: Set("1234567890"),
 		})
 
 		assert.Nil(t, err)
 		assert.NotNil(t, user)
 		assert.Equal(t, "1234567890", user.Number)
 	})
+
+	assert.NotPanics(t, func() {
+		client.Users.UpdateAttributes(fakeUser.Uid, nil)
+	})
+}
+
+func TestUpdateUserAttributesInput_JSON(t *testing.T) {
+	input := UpdateUserAttributesInput{
+		FirstName:  Set("Ada"),
+		LastName:   Null[string](),
+		Email:      Set(""),
+		Meta:       map[string]interface{}{"plan": "pro"},
+		DeleteMeta: []string{"churned_at", "coupon"},
+		IfMatch:    `"v1"`,
+	}
+
+	payload, err := json.Marshal(&input)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"first_name":"Ada","last_name":null,"email":"",
+		"meta":{"plan":"pro","churned_at":null,"coupon":null}}`, string(payload))
+
+	var decoded UpdateUserAttributesInput
+	assert.Nil(t, json.Unmarshal(payload, &decoded))
+	input.IfMatch = ""
+	assert.Equal(t, input, decoded)
+
+	value, ok := decoded.FirstName.Get()
+	assert.True(t, ok)
+	assert.Equal(t, "Ada", value)
+	assert.True(t, decoded.LastName.IsNull())
+	assert.False(t, decoded.Number.IsSet())
+
+	// Nothing set encodes to an empty object
+	payload, err = json.Marshal(&UpdateUserAttributesInput{IfMatch: `"v1"`})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{}`, string(payload))
+
+	_, err = json.Marshal(&UpdateUserAttributesInput{
+		Meta:       map[string]interface{}{"plan": "pro"},
+		DeleteMeta: []string{"plan"},
+	})
+	assert.NotNil(t, err)
 }
 
 func TestUsers_AddEvent(t *testing.T) {
@@ -161,81 +215,1500 @@ func TestUsers_AddEvent(t *testing.T) {
 
 		assert.Nil(t, err)
 	})
+
+	assert.NotPanics(t, func() {
+		assert.NotNil(t, client.Users.AddEvent(fakeUser.Uid, nil))
+	})
+}
+
+func TestEventRegistry(t *testing.T) {
+	type signedUp struct {
+		Plan     string     `engage:"plan"`
+		Seats    int        `engage:"seats"`
+		Referrer *string    `engage:"referrer"`
+		TrialEnd *time.Time `engage:"trial_end"`
+	}
+
+	registry := NewEventRegistry(ValidationStrict)
+	assert.Nil(t, registry.RegisterStruct("signup", signedUp{}))
+	assert.Nil(t, registry.RegisterJSONSchema("purchase", []byte(`{
+		"type": "object",
+		"properties": {"amount": {"type": "number"}, "paid_at": {"type": "string", "format": "date-time"}},
+		"required": ["amount"]
+	}`)))
+	assert.NotNil(t, registry.RegisterStruct("bad", struct {
+		Tags []string `engage:"tags"`
+	}{}))
+	assert.NotNil(t, registry.RegisterJSONSchema("bad", []byte(`{"type": "array"}`)))
+	assert.NotNil(t, registry.Register("bad", EventSchema{Properties: map[string]PropertySchema{"a": {Type: "object"}}}))
+
+	assert.Nil(t, registry.Validate(&AddUserEvent{
+		Event:      "signup",
+		Properties: map[string]interface{}{"plan": "pro", "seats": 3, "trial_end": time.Now()},
+	}))
+	assert.Nil(t, registry.Validate(&AddUserEvent{
+		Event:      "purchase",
+		Properties: map[string]interface{}{"amount": 9.99, "paid_at": "2021-05-01T10:00:00Z", "coupon": "X"},
+	}))
+
+	err := registry.Validate(&AddUserEvent{
+		Event:      "signup",
+		Properties: map[string]interface{}{"seats": 1.5, "referer": "ads"},
+	})
+	var validationErr *EventValidationError
+	assert.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, []string{"plan is required", "referer is not a known property", "seats must be of type integer, got float64"}, validationErr.Problems)
+
+	assert.NotNil(t, registry.Validate(&AddUserEvent{Event: "sign_up"}))
+	assert.NotNil(t, registry.Validate(nil))
+	assert.NotNil(t, registry.Validate(&AddUserEvent{Event: "purchase", Properties: map[string]interface{}{"amount": "9.99"}}))
+
+	// Strict mode rejects invalid events before they are sent
+	logger := &recordingLogger{}
+	c := newTestClient(fakeService.URL, NewConfig().WithEventRegistry(registry).WithLogger(logger))
+	err = c.Users.AddEvent(fakeUser.Uid, &AddUserEvent{Event: "sign_up"})
+	assert.True(t, errors.As(err, &validationErr))
+	assert.NotNil(t, c.Users.AddEvent(fakeUser.Uid, nil))
+	assert.Nil(t, c.Users.AddEvent(fakeUser.Uid, &AddUserEvent{Event: "signup", Properties: map[string]interface{}{"plan": "pro", "seats": 1}}))
+
+	// Warn mode logs them and sends them anyway
+	registry.SetMode(ValidationWarn)
+	assert.Nil(t, c.Users.AddEvent(fakeUser.Uid, &AddUserEvent{Event: "sign_up"}))
+	assert.Equal(t, 1, len(logger.lines))
+
+	registry.SetMode(ValidationOff)
+	assert.Nil(t, c.Users.AddEvent(fakeUser.Uid, &AddUserEvent{Event: "sign_up"}))
+	assert.Equal(t, 1, len(logger.lines))
+}
+
+type orderPlaced struct {
+	Amount   float64   `engage:",value"`
+	Currency string    `engage:"currency"`
+	Coupon   *string   `engage:"coupon,omitempty"`
+	PaidAt   time.Time `engage:"paid_at"`
+}
+
+func (orderPlaced) EventName() string { return "order_placed" }
+
+type planChanged struct {
+	Plan string `engage:"plan"`
+}
+
+func (e *planChanged) EventName() string { return "plan_changed" }
+
+func TestTrack(t *testing.T) {
+	var received AddUserEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	paidAt := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	c := newTestClient(server.URL, NewConfig())
+	err := Track(context.Background(), c, fakeUser.Uid, orderPlaced{Amount: 25.5, Currency: "USD", PaidAt: paidAt})
+	assert.Nil(t, err)
+	assert.Equal(t, "order_placed", received.Event)
+	assert.Equal(t, 25.5, received.Value)
+	assert.Equal(t, map[string]interface{}{"currency": "USD", "paid_at": "2021-05-01T10:00:00Z"}, received.Properties)
+
+	// Typed events can be declared in the registry and are validated like any other event
+	registry := NewEventRegistry(ValidationStrict)
+	assert.Nil(t, RegisterEvent[orderPlaced](registry))
+	c = newTestClient(server.URL, NewConfig().WithEventRegistry(registry).WithCache(CacheOptions{}))
+	err = Track(context.Background(), c, fakeUser.Uid, orderPlaced{Currency: "USD", Coupon: String("SPRING")})
+	assert.Nil(t, err)
+	assert.Equal(t, "SPRING", received.Properties["coupon"])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Track(ctx, c, fakeUser.Uid, orderPlaced{Currency: "USD"})
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	assert.NotNil(t, Track(context.Background(), nil, fakeUser.Uid, orderPlaced{}))
+
+	// Pointers to events can be registered and tracked whatever the receiver of EventName
+	assert.Nil(t, RegisterEvent[*planChanged](registry))
+	assert.Nil(t, RegisterEvent[*orderPlaced](registry))
+	assert.NotNil(t, RegisterEvent[Event](registry))
+
+	received = AddUserEvent{}
+	assert.Nil(t, Track(context.Background(), c, fakeUser.Uid, &planChanged{Plan: "pro"}))
+	assert.Equal(t, "plan_changed", received.Event)
+	assert.Equal(t, map[string]interface{}{"plan": "pro"}, received.Properties)
+
+	assert.NotNil(t, Track(context.Background(), c, fakeUser.Uid, (*orderPlaced)(nil)))
+	assert.NotNil(t, Track[Event](context.Background(), c, fakeUser.Uid, nil))
+}
+
+func TestUsers_AddEvents(t *testing.T) {
+	var batches, singles int32
+	batchSupported := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/events/batch":
+			if !batchSupported {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			var input addEventsInput
+			if err := json.NewDecoder(r.Body).Decode(&input); err != nil || len(input.Events) > maxBatchEvents {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			atomic.AddInt32(&batches, 1)
+		case strings.HasSuffix(r.URL.Path, "/events"):
+			if strings.HasPrefix(r.URL.Path, "/users/missing/") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			atomic.AddInt32(&singles, 1)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	events := make([]UserEvent, 250)
+	for i := range events {
+		events[i] = UserEvent{Uid: fmt.Sprintf("user-%v", i), AddUserEvent: AddUserEvent{Event: "login"}}
+	}
+	events[10].Uid = ""
+
+	c := newTestClient(server.URL, NewConfig())
+	output, err := c.Users.AddEvents(context.Background(), events)
+	assert.Nil(t, err)
+	assert.Equal(t, 250, len(output.Results))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&batches))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&singles))
+	assert.Equal(t, []UserEvent{events[10]}, output.Failed())
+
+	// Without batch support events are sent one by one, and the client stops trying batches for a while
+	batchSupported = false
+	events[10].Uid = "missing"
+	c = newTestClient(server.URL, NewConfig())
+	output, err = c.Users.AddEvents(context.Background(), events[:20])
+	assert.Nil(t, err)
+	assert.Equal(t, int32(19), atomic.LoadInt32(&singles))
+	assert.Equal(t, []UserEvent{events[10]}, output.Failed())
+	assert.True(t, c.batchEventsUnsupported())
+
+	_, err = c.Users.AddEvents(context.Background(), events[:5])
+	assert.Nil(t, err)
+	assert.Equal(t, int32(24), atomic.LoadInt32(&singles))
+
+	// Batches are tried again once the probe interval has passed
+	batchSupported = true
+	atomic.StoreInt64(&c.batchUnsupportedUntil, time.Now().Add(-time.Second).UnixNano())
+	_, err = c.Users.AddEvents(context.Background(), events[:5])
+	assert.Nil(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&batches))
+	assert.Equal(t, int32(24), atomic.LoadInt32(&singles))
+	assert.False(t, c.batchEventsUnsupported())
+
+	// Batches are split by size as well as count
+	large := make([]UserEvent, 3)
+	for i := range large {
+		large[i] = UserEvent{Uid: "user", AddUserEvent: AddUserEvent{Event: "upload", Value: strings.Repeat("x", maxBatchSize/2)}}
+	}
+	results := make([]*AddEventsResult, len(large))
+	for i := range large {
+		results[i] = &AddEventsResult{Event: large[i]}
+	}
+	split := batchEvents(results, []int{0, 1, 2})
+	assert.Equal(t, [][]int{{0}, {1}, {2}}, split)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	output, err = c.Users.AddEvents(ctx, events[:3])
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, 3, len(output.Failed()))
+}
+
+func TestBackfill(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []string
+		keys     []string
+		failOnce = true
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event AddUserEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil || event.Timestamp == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if event.Event == "rejected" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		if event.Event == "purchase" && failOnce {
+			failOnce = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, fmt.Sprintf("%v:%v:%v", strings.TrimPrefix(r.URL.Path, "/users/"), event.Event, event.Timestamp.Format(time.RFC3339)))
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	input := `{"uid": "u1", "event": "login", "timestamp": "2021-05-01T10:00:00Z", "key": "e1"}
+{"uid": "u1", "event": "login", "timestamp": "2021-05-01T10:00:00Z", "key": "e1"}
+not json
+
+{"uid": "u2", "event": "signup", "timestamp": "2021-05-02T10:00:00Z", "properties": {"plan": "pro"}}
+{"uid": "u2", "event": "signup", "timestamp": "2021-05-02T10:00:00Z", "properties": {"plan": "pro"}}
+{"uid": "u3", "event": "rejected", "timestamp": "2021-05-03T10:00:00Z"}
+{"uid": "u3", "event": "login"}
+{"uid": "u3", "event": "purchase", "value": 10, "timestamp": "2021-05-04T10:00:00Z"}
+{"uid": "u4", "event": "login", "timestamp": "2021-05-05T10:00:00Z", "key": "e1"}
+{"uid": "u4", "event": "logout", "timestamp": "2021-05-06T10:00:00Z"}
+`
+	var failed []int
+	backfill := &Backfill{
+		Users:              newTestClient(server.URL, NewConfig()).Users,
+		CheckpointFile:     filepath.Join(t.TempDir(), "checkpoint.json"),
+		CheckpointInterval: 2,
+		RateLimit:          RateLimit{RequestsPerSecond: 1000},
+		OnError: func(record int, event *UserEvent, err error) {
+			failed = append(failed, record)
+		},
+	}
+
+	// The run stops at the purchase, which fails with a server error
+	result, err := backfill.Run(context.Background(), strings.NewReader(input))
+	assert.NotNil(t, err)
+	assert.Equal(t, BackfillResult{Sent: 2, Duplicates: 2, Failed: 3}, *result)
+	assert.Equal(t, []int{2, 5, 6}, failed)
+
+	// Resuming sends the purchase and what follows it, and keeps deduplicating against the earlier events
+	result, err = backfill.Run(context.Background(), strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.Equal(t, BackfillResult{Resumed: 7, Sent: 2, Duplicates: 1}, *result)
+	assert.Equal(t, []string{
+		"u1/events:login:2021-05-01T10:00:00Z",
+		"u2/events:signup:2021-05-02T10:00:00Z",
+		"u3/events:purchase:2021-05-04T10:00:00Z",
+		"u4/events:logout:2021-05-06T10:00:00Z",
+	}, received)
+
+	// Events are sent with their key, or their hash, as idempotency key so resends after a crash are deduplicated
+	assert.Equal(t, "e1", keys[0])
+	for _, key := range keys[1:] {
+		assert.True(t, strings.HasPrefix(key, "backfill:"), key)
+	}
+	assert.NotEqual(t, keys[1], keys[2])
+
+	// Once finished, running again sends nothing
+	result, err = backfill.Run(context.Background(), strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, result.Sent)
+
+	received = nil
+	csvBackfill := &Backfill{Users: backfill.Users, Format: BackfillCSV}
+	result, err = csvBackfill.Run(context.Background(), strings.NewReader(`uid,event,timestamp,value,browser
+u5,login,2021-05-07T10:00:00Z,1,Chrome
+u5,login,2021-05-07T10:00:00Z,1,Chrome
+u5,login,yesterday,1,Chrome
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, BackfillResult{Sent: 1, Duplicates: 1, Failed: 1}, *result)
+	assert.Equal(t, []string{"u5/events:login:2021-05-07T10:00:00Z"}, received)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = (&Backfill{Users: backfill.Users}).Run(ctx, strings.NewReader(input))
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestDedupStores(t *testing.T) {
+	memory := NewMemoryDedupStore(2, 50*time.Millisecond)
+	for _, key := range []string{"a", "b"} {
+		seen, err := memory.Seen(key)
+		assert.Nil(t, err)
+		assert.False(t, seen)
+		assert.Nil(t, memory.Commit(key))
+	}
+	seen, _ := memory.Seen("a")
+	assert.True(t, seen)
+
+	time.Sleep(60 * time.Millisecond)
+	seen, _ = memory.Seen("b")
+	assert.False(t, seen)
+
+	filename := filepath.Join(t.TempDir(), "dedup")
+	file, err := NewFileDedupStore(filename, time.Hour)
+	assert.Nil(t, err)
+	for _, key := range []string{"a", "line\nbreak"} {
+		assert.Nil(t, file.Commit(key))
+	}
+	assert.Nil(t, file.Close())
+
+	// Keys survive reopening the store, except expired ones
+	file, err = NewFileDedupStore(filename, time.Hour)
+	assert.Nil(t, err)
+	seen, _ = file.Seen("a")
+	assert.True(t, seen)
+	seen, _ = file.Seen("line\nbreak")
+	assert.True(t, seen)
+	seen, _ = file.Seen("b")
+	assert.False(t, seen)
+
+	file.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	seen, _ = file.Seen("a")
+	assert.False(t, seen)
+	assert.Nil(t, file.Close())
+}
+
+func TestFileDedupStore_Compaction(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dedup")
+	file, err := NewFileDedupStore(filename, time.Hour)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	now := time.Now()
+	file.now = func() time.Time { return now }
+	for i := 0; i < 3*minDedupCompactLines; i++ {
+		// Every key expires before the next one is committed
+		now = now.Add(time.Hour)
+		assert.Nil(t, file.Commit(fmt.Sprintf("key_%v", i)))
+	}
+
+	// Expired keys are dropped from memory and from the file as commits go on
+	assert.LessOrEqual(t, len(file.keys), minDedupCompactLines)
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, strings.Count(string(content), "\n"), minDedupCompactLines)
+
+	seen, _ := file.Seen(fmt.Sprintf("key_%v", 3*minDedupCompactLines-1))
+	assert.True(t, seen)
+}
+
+func TestUsers_AddEventIdempotency(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		keys    []string
+		batches int
+		fail    = true
+		block   = make(chan struct{})
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users/slow/events" {
+			<-block
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/events/batch" {
+			batches++
+			_, _ = w.Write([]byte(`{"status":"ok"}`))
+			return
+		}
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	dedup := NewMemoryDedupStore(0, time.Minute)
+	c := newTestClient(server.URL, NewConfig().WithDedup(dedup))
+	event := &AddUserEvent{Event: "login", IdempotencyKey: "evt_1"}
+
+	// Keys are only committed once their event is sent, so a failed event can be sent again
+	assert.NotNil(t, c.Users.AddEvent(fakeUser.Uid, event))
+	seen, _ := dedup.Seen("evt_1")
+	assert.False(t, seen)
+	assert.Nil(t, c.Users.AddEvent(fakeUser.Uid, event))
+	assert.Nil(t, c.Users.AddEvent(fakeUser.Uid, event))
+	assert.Nil(t, c.Users.AddEvent(fakeUser.Uid, &AddUserEvent{Event: "login"}))
+	assert.Equal(t, []string{"evt_1", ""}, keys)
+
+	// Events with a key are sent on their own with the header, and duplicates are reported
+	output, err := c.Users.AddEvents(context.Background(), []UserEvent{
+		{Uid: "u1", AddUserEvent: AddUserEvent{Event: "login", IdempotencyKey: "evt_1"}},
+		{Uid: "u1", AddUserEvent: AddUserEvent{Event: "login", IdempotencyKey: "evt_2"}},
+		{Uid: "u1", AddUserEvent: AddUserEvent{Event: "login", IdempotencyKey: "evt_2"}},
+		{Uid: "u1", AddUserEvent: AddUserEvent{Event: "login"}},
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, output.Failed())
+	assert.Equal(t, []bool{true, false, true, false}, []bool{output.Results[0].Duplicate, output.Results[1].Duplicate,
+		output.Results[2].Duplicate, output.Results[3].Duplicate})
+	assert.Equal(t, []string{"evt_1", "", "evt_2"}, keys)
+	assert.Equal(t, 1, batches)
+
+	// An event whose key is being sent by another call isn't sent twice
+	done := make(chan error)
+	go func() { done <- c.Users.AddEvent("slow", &AddUserEvent{Event: "login", IdempotencyKey: "evt_3"}) }()
+	assert.Eventually(t, func() bool {
+		_, inFlight := c.inflight.Load("evt_3")
+		return inFlight
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, ErrEventInFlight, c.Users.AddEvent("slow", &AddUserEvent{Event: "login", IdempotencyKey: "evt_3"}))
+	close(block)
+	assert.Nil(t, <-done)
+	seen, _ = dedup.Seen("evt_3")
+	assert.True(t, seen)
+}
+
+func TestUsers_Delete(t *testing.T) {
+	assert.NotPanics(t, func() {
+		output, err := client.Users.Delete(fakeUser.Uid)
+
+		assert.Nil(t, err)
+		assert.NotNil(t, output)
+		assert.Equal(t, "ok", output.Status)
+	})
+}
+
+func TestUsers_Merge(t *testing.T) {
+	assert.NotPanics(t, func() {
+		output, err := client.Users.Merge("anonymous-123", fakeUser.Uid)
+
+		assert.Nil(t, err)
+		assert.NotNil(t, output)
+		assert.Equal(t, "queued", output.Status)
+
+		_, err = client.Users.Merge(fakeUser.Uid, fakeUser.Uid)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestClient_EraseUser(t *testing.T) {
+	assert.NotPanics(t, func() {
+		output, err := client.EraseUser(fakeUser.Uid)
+
+		assert.Nil(t, err)
+		assert.NotNil(t, output)
+		assert.Equal(t, "ok", output.Status)
+	})
+}
+
+func TestUsers_AddDevice(t *testing.T) {
+	assert.NotPanics(t, func() {
+		user, err := client.Users.AddDevice(fakeUser.Uid, &AddDeviceInput{
+			Token:    "ZXCVBNM",
+			Platform: DevicePlatformAndroid,
+		})
+
+		assert.Nil(t, err)
+		assert.NotNil(t, user)
+
+		_, err = client.Users.AddDevice(fakeUser.Uid, &AddDeviceInput{
+			Token:    "ZXCVBNM",
+			Platform: "APPLE",
+		})
+		assert.NotNil(t, err)
+	})
+}
+
+func TestUsers_RemoveDevice(t *testing.T) {
+	assert.NotPanics(t, func() {
+		err := client.Users.RemoveDevice(fakeUser.Uid, fakeUser.Devices[0].Token)
+		assert.Nil(t, err)
+	})
+}
+
+func TestUsers_ListDevices(t *testing.T) {
+	assert.NotPanics(t, func() {
+		devices, err := client.Users.ListDevices(fakeUser.Uid)
+
+		assert.Nil(t, err)
+		assert.Equal(t, fakeUser.Devices, devices)
+	})
+}
+
+func TestGetAs(t *testing.T) {
+	type profile struct {
+		A       string  `engage:"property_a"`
+		B       *string `engage:"property_b"`
+		Missing int     `engage:"missing"`
+	}
+
+	user, meta, err := GetAs[profile](client.Users, fakeUser.Uid)
+	assert.Nil(t, err)
+	assert.Equal(t, fakeUser.Uid, user.Uid)
+	assert.Equal(t, "value_a", meta.A)
+	assert.Equal(t, "value_b", *meta.B)
+	assert.Equal(t, 0, meta.Missing)
+
+	_, _, err = GetAs[int](client.Users, fakeUser.Uid)
+	assert.NotNil(t, err)
+}
+
+func TestDecodeMeta(t *testing.T) {
+	type profile struct {
+		Plan      string     `engage:"plan"`
+		Orders    int        `engage:"orders"`
+		Small     int8       `engage:"small"`
+		Big       int64      `engage:"big"`
+		Count     uint64     `engage:"count"`
+		Score     float64    `engage:"score"`
+		Verified  bool       `engage:"verified"`
+		ChurnedAt *time.Time `engage:"churned_at"`
+		Ignored   string     `engage:"-"`
+		Untagged  string
+	}
+
+	var meta map[string]interface{}
+	err := json.Unmarshal([]byte(`{"plan":"pro","orders":12,"small":3,"score":4.5,"verified":true,
+		"churned_at":"2021-05-01T10:00:00Z","Ignored":"x","Untagged":"y"}`), &meta)
+	assert.Nil(t, err)
+
+	p, err := DecodeMeta[profile](meta)
+	assert.Nil(t, err)
+	assert.Equal(t, "pro", p.Plan)
+	assert.Equal(t, 12, p.Orders)
+	assert.Equal(t, int8(3), p.Small)
+	assert.Equal(t, 4.5, p.Score)
+	assert.True(t, p.Verified)
+	assert.Equal(t, time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC), p.ChurnedAt.UTC())
+	assert.Empty(t, p.Ignored)
+	assert.Empty(t, p.Untagged)
+
+	p, err = DecodeMeta[profile](map[string]interface{}{"big": -math.Pow(2, 63), "count": math.Pow(2, 63)})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(math.MinInt64), p.Big)
+	assert.Equal(t, uint64(1<<63), p.Count)
+
+	invalid := []map[string]interface{}{
+		{"plan": 1.0},
+		{"orders": 1.5},
+		{"orders": "12"},
+		{"small": 300.0},
+		{"big": math.Pow(2, 63)},
+		{"count": math.Pow(2, 64)},
+		{"count": -1.0},
+		{"verified": "true"},
+		{"churned_at": "yesterday"},
+	}
+	for _, m := range invalid {
+		_, err := DecodeMeta[profile](m)
+		var fieldErr *MetaFieldError
+		assert.True(t, errors.As(err, &fieldErr), "%v", m)
+	}
+}
+
+func TestMetaOf(t *testing.T) {
+	churnedAt := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	type profile struct {
+		Plan      string     `engage:"plan"`
+		Orders    int        `engage:"orders,omitempty"`
+		ChurnedAt *time.Time `engage:"churned_at"`
+		Ignored   string
+	}
+
+	meta, err := MetaOf(profile{Plan: "pro", ChurnedAt: &churnedAt, Ignored: "x"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"plan": "pro", "churned_at": "2021-05-01T10:00:00Z"}, meta)
+
+	meta, err = MetaOf(&profile{Orders: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"plan": "", "orders": 2}, meta)
+
+	_, err = MetaOf(struct {
+		Tags []string `engage:"tags"`
+	}{})
+	var fieldErr *MetaFieldError
+	assert.True(t, errors.As(err, &fieldErr))
+
+	_, err = MetaOf("plan")
+	assert.NotNil(t, err)
+
+	// A round trip through JSON gives back the same struct
+	payload, _ := json.Marshal(map[string]interface{}{"plan": "pro", "orders": 3, "churned_at": "2021-05-01T10:00:00Z"})
+	var decoded map[string]interface{}
+	_ = json.Unmarshal(payload, &decoded)
+	p, err := DecodeMeta[profile](decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, profile{Plan: "pro", Orders: 3, ChurnedAt: p.ChurnedAt}, p)
+	assert.True(t, churnedAt.Equal(*p.ChurnedAt))
+
+	user, err := UpdateMetaAs(client.Users, fakeUser.Uid, profile{Plan: "pro"})
+	assert.Nil(t, err)
+	assert.NotNil(t, user)
+}
+
+func TestSegmentAdapter(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		bodies   []map[string]interface{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		bodies = append(bodies, body)
+		mu.Unlock()
+
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/users/new_user":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case r.URL.Path == "/users/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	adapter := &SegmentAdapter{Users: newTestClient(server.URL, NewConfig()).Users}
+	err := adapter.HandleJSON(context.Background(), []byte(`{"type": "identify", "userId": "u1",
+		"traits": {"firstName": "Ada", "email": "ada@heroshe.com", "phone": "2348012345678", "plan": "pro"}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "PUT /users/u1", requests[0])
+	assert.Equal(t, map[string]interface{}{"first_name": "Ada", "email": "ada@heroshe.com",
+		"number": "2348012345678", "meta": map[string]interface{}{"plan": "pro"}}, bodies[0])
+
+	// Unknown users are created
+	err = adapter.Handle(context.Background(), &SegmentMessage{Type: "identify", AnonymousId: "new_user",
+		Traits: map[string]interface{}{"last_name": "Lovelace", "createdAt": "2021-05-01T10:00:00Z"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"PUT /users/new_user", "POST /users"}, requests[1:3])
+	assert.Equal(t, map[string]interface{}{"id": "new_user", "last_name": "Lovelace", "created_at": "2021-05-01T10:00:00Z"}, bodies[2])
+
+	err = adapter.Handle(context.Background(), &SegmentMessage{Type: "group", UserId: "u1", GroupId: "acme",
+		Traits: map[string]interface{}{"name": "Acme"}})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"meta": map[string]interface{}{"group_id": "acme", "group_name": "Acme"}}, bodies[3])
+
+	for _, msg := range []*SegmentMessage{
+		{Type: "track", Event: "login"},
+		{Type: "track", UserId: "u1"},
+		{Type: "group", UserId: "u1"},
+		{Type: "page", UserId: "u1"},
+	} {
+		assert.True(t, errors.Is(adapter.Handle(context.Background(), msg), ErrInvalidSegmentMessage), msg.Type)
+	}
+
+	handler := &SegmentHandler{Adapter: adapter, WriteKey: "write_key"}
+	serve := func(path, body string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if auth {
+			req.SetBasicAuth("write_key", "")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("/v1/track", `{"userId": "u1", "event": "Order Placed", "messageId": "m1",
+		"properties": {"total": 25}, "timestamp": "2021-05-01T10:00:00Z"}`, true)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "PUT /users/u1/events", requests[len(requests)-1])
+	assert.Equal(t, map[string]interface{}{"event": "Order Placed", "properties": map[string]interface{}{"total": 25.0},
+		"timestamp": "2021-05-01T10:00:00Z"}, bodies[len(bodies)-1])
+
+	rec = serve("/v1/batch", `{"batch": [{"type": "identify", "userId": "u2", "traits": {"plan": "free"}},
+		{"type": "track", "userId": "u2", "event": "Signed Up"}]}`, true)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"PUT /users/u2", "PUT /users/u2/events"}, requests[len(requests)-2:])
+
+	// A batch with an invalid or null message is rejected before any call is applied
+	sent := len(requests)
+	for _, body := range []string{
+		`{"batch": [{"type": "track", "userId": "u2", "event": "Signed Up"}, null]}`,
+		`{"batch": [{"type": "track", "userId": "u2", "event": "Signed Up"}, {"type": "track", "userId": "u2"}]}`,
+	} {
+		rec = serve("/v1/batch", body, true)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"index":1`)
+	}
+	assert.Len(t, requests, sent)
+
+	// Calls the API fails don't stop the rest of the batch
+	rec = serve("/v1/batch", `{"batch": [{"type": "track", "userId": "u2", "event": "Signed Up"},
+		{"type": "identify", "userId": "fail", "traits": {"plan": "free"}},
+		{"type": "track", "userId": "u3", "event": "Signed Up"}]}`, true)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"index":1`)
+	assert.NotContains(t, rec.Body.String(), `"index":2`)
+	assert.Equal(t, "PUT /users/u3/events", requests[len(requests)-1])
+	assert.True(t, errors.Is(adapter.Handle(context.Background(), nil), ErrInvalidSegmentMessage))
+
+	assert.Equal(t, http.StatusUnauthorized, serve("/v1/track", `{}`, false).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("/v1/track", `{"userId": "u1"}`, true).Code)
+	assert.Equal(t, http.StatusBadRequest, serve("/v1/identify", `not json`, true).Code)
+	assert.Equal(t, http.StatusNotFound, serve("/v1/page", `{}`, true).Code)
+}
+
+func TestCloudEventsHandler(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		bodies   []map[string]interface{}
+		keys     []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		bodies = append(bodies, body)
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		mu.Unlock()
+		if r.URL.Path == "/users/fail/events" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	handler := &CloudEventsHandler{Users: newTestClient(server.URL, NewConfig()).Users}
+	serve := func(body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Structured mode
+	rec := serve(`{"specversion": "1.0", "id": "e1", "source": "/orders", "type": "order.placed", "subject": "u1",
+		"time": "2021-05-01T10:00:00Z", "data": {"total": 25}}`, map[string]string{"Content-Type": "application/cloudevents+json"})
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "PUT /users/u1/events", requests[0])
+	assert.Equal(t, map[string]interface{}{"event": "order.placed", "properties": map[string]interface{}{"total": 25.0},
+		"timestamp": "2021-05-01T10:00:00Z"}, bodies[0])
+	assert.Equal(t, "/orders/e1", keys[0])
+
+	// Binary mode
+	rec = serve(`{"plan": "pro"}`, map[string]string{
+		"Content-Type":   "application/json",
+		"Ce-Specversion": "1.0",
+		"Ce-Id":          "e2",
+		"Ce-Source":      "/billing",
+		"Ce-Type":        "plan.changed",
+		"Ce-Subject":     "user%20two",
+	})
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "PUT /users/user two/events", requests[1])
+	assert.Equal(t, map[string]interface{}{"event": "plan.changed", "properties": map[string]interface{}{"plan": "pro"}}, bodies[1])
+
+	// Batched mode
+	rec = serve(`[{"specversion": "1.0", "id": "e3", "source": "/auth", "type": "login", "subject": "u3"},
+		{"specversion": "1.0", "id": "e4", "source": "/auth", "type": "logout", "subject": "u3", "data": 5}]`,
+		map[string]string{"Content-Type": "application/cloudevents-batch+json"})
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, []string{"PUT /users/u3/events", "PUT /users/u3/events"}, requests[2:4])
+	assert.Equal(t, map[string]interface{}{"event": "logout", "properties": map[string]interface{}{"data": 5.0}}, bodies[3])
+
+	for _, body := range []string{
+		`not json`,
+		`{"specversion": "0.3", "id": "e5", "source": "/auth", "type": "login", "subject": "u3"}`,
+		`{"specversion": "1.0", "source": "/auth", "type": "login", "subject": "u3"}`,
+		`{"specversion": "1.0", "id": "e5", "source": "/auth", "type": "login"}`,
+		`{"specversion": "1.0", "id": "e5", "source": "/auth", "type": "login", "subject": "u3", "time": "yesterday"}`,
+		`{"specversion": "1.0", "id": "e5", "source": "/auth", "type": "login", "subject": "u3", "datacontenttype": "text/plain", "data_base64": "aGk="}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, serve(body, map[string]string{"Content-Type": "application/cloudevents+json"}).Code, body)
+	}
+	assert.Equal(t, http.StatusBadRequest, serve(`{}`, map[string]string{"Content-Type": "application/json"}).Code)
+	assert.Len(t, requests, 4)
+
+	// The uid can come from an extension
+	converter := CloudEventConverter{UidExtension: "userid"}
+	uid, event, err := converter.Convert(&CloudEvent{SpecVersion: "1.0", Id: "e6", Source: "/auth", Type: "login",
+		Subject: "session", Extensions: map[string]interface{}{"userid": "u4"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "u4", uid)
+	assert.Equal(t, &AddUserEvent{Event: "login", IdempotencyKey: "/auth/e6"}, event)
+
+	_, _, err = converter.Convert(&CloudEvent{SpecVersion: "1.0", Id: "e7", Source: "/auth", Type: "login", Subject: "u4"})
+	assert.True(t, errors.Is(err, ErrInvalidCloudEvent))
+
+	// Numbers of the data are checked against a strict registry
+	registry := NewEventRegistry(ValidationStrict)
+	assert.Nil(t, registry.Register("order.placed", EventSchema{Properties: map[string]PropertySchema{
+		"total": {Type: PropertyNumber, Required: true}, "items": {Type: PropertyInteger}}}))
+	handler.Users = newTestClient(server.URL, NewConfig().WithEventRegistry(registry)).Users
+
+	rec = serve(`{"specversion": "1.0", "id": "e8", "source": "/orders", "type": "order.placed", "subject": "u1",
+		"data": {"total": 25.5, "items": 9007199254740993}}`, map[string]string{"Content-Type": "application/cloudevents+json"})
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Len(t, requests, 5)
+
+	rec = serve(`{"specversion": "1.0", "id": "e9", "source": "/orders", "type": "order.placed", "subject": "u1",
+		"data": {"total": 25, "items": 1.5}}`, map[string]string{"Content-Type": "application/cloudevents+json"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "items must be of type integer")
+	assert.Len(t, requests, 5)
+
+	// A batch with an invalid event is rejected before any event is sent
+	rec = serve(`[{"specversion": "1.0", "id": "e10", "source": "/orders", "type": "order.placed", "subject": "u1", "data": {"total": 5}},
+		{"specversion": "1.0", "id": "e11", "source": "/orders", "type": "order.placed", "subject": "u1", "data": {"total": "5"}}]`,
+		map[string]string{"Content-Type": "application/cloudevents-batch+json"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Len(t, requests, 5)
+
+	// Events the API fails don't stop the rest of the batch
+	handler.Users = newTestClient(server.URL, NewConfig()).Users
+	rec = serve(`[{"specversion": "1.0", "id": "e12", "source": "/auth", "type": "login", "subject": "fail"},
+		{"specversion": "1.0", "id": "e13", "source": "/auth", "type": "login", "subject": "u3"}]`,
+		map[string]string{"Content-Type": "application/cloudevents-batch+json"})
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Contains(t, rec.Body.String(), "event e12")
+	assert.NotContains(t, rec.Body.String(), "event e13")
+	assert.Equal(t, "PUT /users/u3/events", requests[len(requests)-1])
+}
+
+func TestTrackingMiddleware(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		bodies   []map[string]interface{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		bodies = append(bodies, body)
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	middleware := &TrackingMiddleware{
+		Users:         newTestClient(server.URL, NewConfig()).Users,
+		UserId:        func(r *http.Request) string { return r.Header.Get("X-User") },
+		Event:         "api_request",
+		LastSeenField: "last_seen_at",
+		Sample: func(r *http.Request, status int) float64 {
+			if status == http.StatusNotFound {
+				return 0
+			}
+			return 1
+		},
+	}
+	handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	serve := func(path, uid string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if uid != "" {
+			req.Header.Set("X-User", uid)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, serve("/orders", "u1"))
+	assert.Equal(t, http.StatusCreated, serve("/orders", ""))
+	assert.Equal(t, http.StatusNotFound, serve("/missing", "u1"))
+	assert.Nil(t, middleware.Close(context.Background()))
+
+	// Anonymous requests aren't tracked, 404s aren't sampled and last_seen_at is only updated once
+	assert.Equal(t, []string{"PUT /users/u1/events", "PUT /users/u1"}, requests)
+	assert.Equal(t, "api_request", bodies[0]["event"])
+	properties := bodies[0]["properties"].(map[string]interface{})
+	assert.Equal(t, "/orders", properties["route"])
+	assert.Equal(t, "POST", properties["method"])
+	assert.Equal(t, 201.0, properties["status"])
+	assert.Contains(t, bodies[1]["meta"], "last_seen_at")
+
+	// Requests are served after Close but no longer tracked
+	assert.Equal(t, http.StatusCreated, serve("/orders", "u2"))
+	assert.Len(t, requests, 2)
+}
+
+func TestTrackingMiddleware_NeverBlocks(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	var errs int64
+	middleware := &TrackingMiddleware{
+		Users:     newTestClient(server.URL, NewConfig()).Users,
+		UserId:    func(r *http.Request) string { return "u1" },
+		QueueSize: 1,
+		OnError: func(uid string, err error) {
+			if errors.Is(err, ErrTrackingQueueFull) {
+				atomic.AddInt64(&errs, 1)
+			}
+		},
+	}
+	handler := middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	assert.Less(t, time.Since(start), time.Second)
+
+	// One request is being sent and one is queued
+	assert.GreaterOrEqual(t, middleware.Dropped(), int64(3))
+	assert.Equal(t, middleware.Dropped(), atomic.LoadInt64(&errs))
+
+	close(release)
+	assert.Nil(t, middleware.Close(context.Background()))
+}
+
+func TestTrackingMiddleware_Hijack(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The last seen update hangs until the worker's deadline
+		if r.Method == http.MethodPut && r.URL.Path == "/users/u1" {
+			// The server only notices the client went away once the body was read
+			_, _ = io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer api.Close()
+
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	middleware := &TrackingMiddleware{
+		Users:         newTestClient(api.URL, NewConfig()).Users,
+		UserId:        func(r *http.Request) string { return "u1" },
+		LastSeenField: "last_seen_at",
+		Timeout:       50 * time.Millisecond,
+		OnError: func(uid string, err error) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		},
+	}
+	server := httptest.NewServer(middleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = rw.Flush()
+	})))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	res.Body.Close()
+
+	start := time.Now()
+	assert.Nil(t, middleware.Close(context.Background()))
+	assert.Less(t, time.Since(start), time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, errs, 1) {
+		assert.True(t, errors.Is(errs[0], context.DeadlineExceeded), errs[0])
+	}
+
+	// Hijacking writers that don't support it fails instead of panicking
+	_, _, err = (&statusRecorder{ResponseWriter: httptest.NewRecorder()}).Hijack()
+	assert.True(t, errors.Is(err, http.ErrNotSupported))
+}
+
+// List Tests
+
+func TestLists_CreateList(t *testing.T) {
+	assert.NotPanics(t, func() {
+		list, err := client.Lists.CreateList(&CreateUpdateListInput{
+			Title:       String(fakeList.Title),
+			Description: String(fakeList.Description),
+			RedirectUrl: String(fakeList.RedirectUrl),
+			DoubleOptIn: Bool(fakeList.DoubleOptIn),
+		})
+
+		assert.Nil(t, err)
+		assert.NotNil(t, list)
+		assert.NotEmpty(t, list.Title)
+		assert.NotEmpty(t, list.Description)
+		assert.NotEmpty(t, list.RedirectUrl)
+		assert.Equal(t, fakeList.Title, list.Title)
+		assert.Equal(t, fakeList.SubscriberCount, list.SubscriberCount)
+		assert.Equal(t, fakeList.BroadcastCount, list.BroadcastCount)
+	})
+}
+
+func TestLists_GetAllLists(t *testing.T) {
+	assert.NotPanics(t, func() {
+		lists, err := client.Lists.GetAllLists(&PaginatorInput{
+			Limit:      nil,
+			NextCursor: nil,
+			PrevCursor: nil,
+		})
+
+		assert.Nil(t, err)
+		assert.NotNil(t, lists)
+		assert.Equal(t, 3, len(lists.Data))
+	})
+}
+
+func TestLists_GetList(t *testing.T) {
+	assert.NotPanics(t, func() {
+		list, err := client.Lists.GetList(fakeList.Id)
+
+		assert.Nil(t, err)
+		assert.NotNil(t, list)
+		assert.Equal(t, fakeList.Title, list.Title)
+		assert.Equal(t, fakeList.SubscriberCount, list.SubscriberCount)
+		assert.Equal(t, fakeList.BroadcastCount, list.BroadcastCount)
+	})
+}
+
+func TestLists_UpdateList(t *testing.T) {
+	assert.NotPanics(t, func() {
+		list, err := client.Lists.UpdateList(fakeList.Id, &CreateUpdateListInput{
+			Title: String("New List Name"),
+		})
+
+		assert.Nil(t, err)
+		assert.NotNil(t, list)
+		assert.Equal(t, "New List Name", list.Title)
+	})
+
+	assert.NotPanics(t, func() {
+		client.Lists.UpdateList(fakeList.Id, nil)
+	})
+}
+
+func TestLists_ArchiveList(t *testing.T) {
+	assert.NotPanics(t, func() {
+		err := client.Lists.ArchiveList(fakeList.Id)
+
+		assert.Nil(t, err)
+	})
+}
+
+func TestLists_UnsubscribeList(t *testing.T) {
+	assert.NotPanics(t, func() {
+		err := client.Lists.UnsubscribeList(fakeList.Id, fakeUser.Uid)
+		assert.Nil(t, err)
+	})
+}
+
+func TestLists_ListSubscribers(t *testing.T) {
+	assert.NotPanics(t, func() {
+		subscribers, err := client.Lists.ListSubscribers(fakeList.Id, &PaginatorInput{
+			Limit: Int(2),
+		})
+
+		assert.Nil(t, err)
+		assert.NotNil(t, subscribers)
+		assert.Equal(t, 2, len(subscribers.Data))
+		assert.Equal(t, "cursor_2", subscribers.NextCursor)
+		assert.True(t, subscribers.Data[0].Subscribed)
+		assert.NotNil(t, subscribers.Data[0].ConfirmedAt)
+		assert.Nil(t, subscribers.Data[1].ConfirmedAt)
+
+		_, err = client.Lists.ListSubscribers(fakeList.Id, &PaginatorInput{
+			NextCursor: String("cursor_2"),
+			PrevCursor: String("cursor_1"),
+		})
+		assert.NotNil(t, err)
+	})
+}
+
+func TestLists_IsSubscribed(t *testing.T) {
+	assert.NotPanics(t, func() {
+		subscribed, err := client.Lists.IsSubscribed(fakeUser.Lists[0].Id, fakeUser.Uid)
+		assert.Nil(t, err)
+		assert.True(t, subscribed)
+
+		subscribed, err = client.Lists.IsSubscribed(fakeUser.Lists[1].Id, fakeUser.Uid)
+		assert.Nil(t, err)
+		assert.False(t, subscribed)
+
+		subscribed, err = client.Lists.IsSubscribed(fakeList.Id, fakeUser.Uid)
+		assert.Nil(t, err)
+		assert.False(t, subscribed)
+	})
+}
+
+func TestLists_BulkSubscribe(t *testing.T) {
+	var (
+		inFlight, maxInFlight int32
+		rateLimited           sync.Once
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		var input SubscribeListInput
+		json.NewDecoder(r.Body).Decode(&input)
+
+		limited := false
+		rateLimited.Do(func() { limited = true })
+		switch {
+		case limited:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case input.Email != nil && strings.HasPrefix(*input.Email, "bad"):
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"uid":"%v"}`, *input.Email)
+		}
+	}))
+	defer server.Close()
+
+	c := newTestClient(server.URL, NewConfig().WithMaxConcurrency(3))
+
+	inputs := []SubscribeListInput{{}}
+	for i := 0; i < 20; i++ {
+		inputs = append(inputs, SubscribeListInput{Email: String(fmt.Sprintf("user%v@heroshe.com", i))})
+	}
+	inputs = append(inputs, SubscribeListInput{Email: String("bad@heroshe.com")})
+
+	output, err := c.Lists.BulkSubscribe(context.Background(), fakeList.Id, inputs)
+	assert.Nil(t, err)
+	assert.Equal(t, len(inputs), len(output.Results))
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(3))
+
+	for i, result := range output.Results[1:21] {
+		assert.Nil(t, result.Err)
+		assert.Equal(t, fmt.Sprintf("user%v@heroshe.com", i), result.Output.Uid)
+	}
+
+	failed := output.Failed()
+	assert.Equal(t, 2, len(failed))
+	assert.Nil(t, failed[0].Email)
+	assert.Equal(t, "bad@heroshe.com", *failed[1].Email)
 }
 
-// List Tests
+func TestLists_BulkUnsubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
 
-func TestLists_CreateList(t *testing.T) {
+	output, err := client.Lists.BulkUnsubscribe(ctx, fakeList.Id, []string{fakeUser.Uid, "987654321"})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []string{fakeUser.Uid, "987654321"}, output.Failed())
+
+	output, err = client.Lists.BulkUnsubscribe(context.Background(), fakeList.Id, []string{fakeUser.Uid, "987654321"})
+	assert.Nil(t, err)
+	assert.Nil(t, output.Results[0].Err)
+	assert.Equal(t, []string{"987654321"}, output.Failed())
+}
+
+func TestLists_PendingConfirmations(t *testing.T) {
 	assert.NotPanics(t, func() {
-		list, err := client.Lists.CreateList(&CreateUpdateListInput{
-			Title:       String(fakeList.Title),
-			Description: String(fakeList.Description),
-			RedirectUrl: String(fakeList.RedirectUrl),
-			DoubleOptIn: Bool(fakeList.DoubleOptIn),
+		pending, err := client.Lists.PendingConfirmations(fakeList.Id, &PaginatorInput{
+			Limit: Int(2),
 		})
 
 		assert.Nil(t, err)
-		assert.NotNil(t, list)
-		assert.NotEmpty(t, list.Title)
-		assert.NotEmpty(t, list.Description)
-		assert.NotEmpty(t, list.RedirectUrl)
-		assert.Equal(t, fakeList.Title, list.Title)
-		assert.Equal(t, fakeList.SubscriberCount, list.SubscriberCount)
-		assert.Equal(t, fakeList.BroadcastCount, list.BroadcastCount)
+		assert.Equal(t, 1, len(pending.Data))
+		assert.Equal(t, "987654321", pending.Data[0].Uid)
+		assert.Equal(t, "cursor_2", pending.NextCursor)
 	})
 }
 
-func TestLists_GetAllLists(t *testing.T) {
+func TestLists_ResendConfirmation(t *testing.T) {
 	assert.NotPanics(t, func() {
-		lists, err := client.Lists.GetAllLists(&PaginatorInput{
-			Limit:      nil,
-			NextCursor: nil,
-			PrevCursor: nil,
-		})
-
+		err := client.Lists.ResendConfirmation(fakeList.Id, fakeUser.Uid)
 		assert.Nil(t, err)
-		assert.NotNil(t, lists)
-		assert.Equal(t, 3, len(lists.Data))
 	})
 }
 
-func TestLists_GetList(t *testing.T) {
-	assert.NotPanics(t, func() {
-		list, err := client.Lists.GetList(fakeList.Id)
+func TestConfirmationSigner(t *testing.T) {
+	signer := NewConfirmationSigner([]byte("secret"), time.Hour)
+
+	token, err := signer.Sign(fakeList.Id, fakeUser.Uid)
+	assert.Nil(t, err)
+
+	claims, err := signer.Verify(token)
+	assert.Nil(t, err)
+	assert.Equal(t, fakeList.Id, claims.ListId)
+	assert.Equal(t, fakeUser.Uid, claims.Uid)
+
+	_, err = NewConfirmationSigner([]byte("another secret"), time.Hour).Verify(token)
+	assert.Equal(t, ErrInvalidConfirmationToken, err)
 
+	_, err = signer.Verify("not-a-token")
+	assert.Equal(t, ErrInvalidConfirmationToken, err)
+
+	signer.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = signer.Verify(token)
+	assert.Equal(t, ErrExpiredConfirmationToken, err)
+}
+
+func TestConfirmationHandler(t *testing.T) {
+	signer := NewConfirmationSigner([]byte("secret"), time.Hour)
+	handler := &ConfirmationHandler{Lists: client.Lists, Signer: signer}
+
+	token, _ := signer.Sign(fakeList.Id, fakeUser.Uid)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/confirm?token="+token, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `<form method="post">`)
+	assert.Contains(t, w.Body.String(), `value="`+token+`"`)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/confirm", strings.NewReader(url.Values{"token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, fakeList.RedirectUrl, w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/confirm?token=invalid", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// Cache Tests
+
+func TestCachedUsers(t *testing.T) {
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+			time.Sleep(20 * time.Millisecond)
+		}
+		user, _ := json.Marshal(fakeUser)
+		w.WriteHeader(200)
+		fmt.Fprintf(w, string(user))
+	}))
+	defer server.Close()
+
+	c := newTestClient(server.URL, NewConfig().WithCache(CacheOptions{Size: 2, TTL: time.Hour}))
+	users, ok := c.Users.(*CachedUsers)
+	assert.True(t, ok)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := users.Get(fakeUser.Uid)
+			assert.Nil(t, err)
+			assert.Equal(t, fakeUser.Email, user.Email)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gets))
+
+	_, err := users.UpdateAttributes(fakeUser.Uid, &UpdateUserAttributesInput{Number: Set("1234567890")})
+	assert.Nil(t, err)
+	_, err = users.Get(fakeUser.Uid)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&gets))
+
+	// Filling the cache past its size evicts the least recently used user
+	users.Get("second")
+	users.Get("third")
+	users.Get(fakeUser.Uid)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&gets))
+}
+
+func TestCachedLists(t *testing.T) {
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			atomic.AddInt32(&gets, 1)
+		case http.MethodDelete:
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"status":"ok"}`)
+			return
+		}
+		list, _ := json.Marshal(fakeList)
+		w.WriteHeader(200)
+		fmt.Fprintf(w, string(list))
+	}))
+	defer server.Close()
+
+	c := newTestClient(server.URL, NewConfig())
+	lists := NewCachedListService(c.Lists, CacheOptions{TTL: 50 * time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		list, err := lists.GetList(fakeList.Id)
 		assert.Nil(t, err)
-		assert.NotNil(t, list)
 		assert.Equal(t, fakeList.Title, list.Title)
-		assert.Equal(t, fakeList.SubscriberCount, list.SubscriberCount)
-		assert.Equal(t, fakeList.BroadcastCount, list.BroadcastCount)
-	})
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gets))
+
+	assert.Nil(t, lists.ArchiveList(fakeList.Id))
+	lists.GetList(fakeList.Id)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&gets))
+
+	time.Sleep(60 * time.Millisecond)
+	lists.GetList(fakeList.Id)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&gets))
 }
 
-func TestLists_UpdateList(t *testing.T) {
-	assert.NotPanics(t, func() {
-		list, err := client.Lists.UpdateList(fakeList.Id, &CreateUpdateListInput{
-			Title: String("New List Name"),
-		})
+func TestCachedLists_Subscribers(t *testing.T) {
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet:
+			atomic.AddInt32(&gets, 1)
+			user, _ := json.Marshal(fakeUser)
+			w.Write(user)
+		case r.Method == http.MethodPost:
+			fmt.Fprintf(w, `{"uid":%q}`, fakeUser.Uid)
+		default:
+			fmt.Fprintf(w, `{"status":"ok"}`)
+		}
+	}))
+	defer server.Close()
 
+	c := newTestClient(server.URL, NewConfig().WithCache(CacheOptions{TTL: time.Hour}))
+	get := func() {
+		_, err := c.Users.Get(fakeUser.Uid)
 		assert.Nil(t, err)
-		assert.NotNil(t, list)
-		assert.Equal(t, "New List Name", list.Title)
-	})
+	}
+
+	// Subscriptions change the lists of the user, so its entry is fetched again
+	get()
+	get()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gets))
+
+	_, err := c.Lists.SubscribeList(fakeList.Id, &SubscribeListInput{Email: String(fakeUser.Email)})
+	assert.Nil(t, err)
+	get()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&gets))
+
+	assert.Nil(t, c.Lists.UnsubscribeList(fakeList.Id, fakeUser.Uid))
+	get()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&gets))
+
+	_, err = c.Lists.BulkSubscribe(context.Background(), fakeList.Id, []SubscribeListInput{{Email: String(fakeUser.Email)}})
+	assert.Nil(t, err)
+	get()
+	assert.Equal(t, int32(4), atomic.LoadInt32(&gets))
+
+	_, err = c.Lists.BulkUnsubscribe(context.Background(), fakeList.Id, []string{fakeUser.Uid})
+	assert.Nil(t, err)
+	get()
+	assert.Equal(t, int32(5), atomic.LoadInt32(&gets))
+
+	// Other users stay cached
+	assert.Nil(t, c.Lists.UnsubscribeList(fakeList.Id, "other"))
+	get()
+	assert.Equal(t, int32(5), atomic.LoadInt32(&gets))
 }
 
-func TestLists_ArchiveList(t *testing.T) {
-	assert.NotPanics(t, func() {
-		err := client.Lists.ArchiveList(fakeList.Id)
+func TestCachedUsers_Revalidation(t *testing.T) {
+	var fetches, notModified int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			if r.Header.Get("If-Match") != `"v1"` {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+		}
 
-		assert.Nil(t, err)
-	})
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		atomic.AddInt32(&fetches, 1)
+		user, _ := json.Marshal(fakeUser)
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(200)
+		fmt.Fprintf(w, string(user))
+	}))
+	defer server.Close()
+
+	c := newTestClient(server.URL, NewConfig().WithCache(CacheOptions{TTL: 10 * time.Millisecond}))
+
+	user, err := c.Users.Get(fakeUser.Uid)
+	assert.Nil(t, err)
+	assert.Equal(t, `"v1"`, user.ETag)
+
+	time.Sleep(20 * time.Millisecond)
+	revalidated, err := c.Users.Get(fakeUser.Uid)
+	assert.Nil(t, err)
+	assert.Equal(t, user, revalidated)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+
+	_, err = c.Users.UpdateAttributes(fakeUser.Uid, &UpdateUserAttributesInput{Number: Set("1234567890"), IfMatch: `"v1"`})
+	assert.Nil(t, err)
+
+	_, err = c.Users.UpdateAttributes(fakeUser.Uid, &UpdateUserAttributesInput{Number: Set("1234567890"), IfMatch: `"v0"`})
+	var conflict *ConflictError
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, http.StatusPreconditionFailed, conflict.Err.Code)
 }
 
-func TestLists_UnsubscribeList(t *testing.T) {
-	assert.NotPanics(t, func() {
-		err := client.Lists.UnsubscribeList(fakeList.Id, fakeUser.Uid)
-		assert.Nil(t, err)
-	})
+// Registry Tests
+
+func TestRegistry(t *testing.T) {
+	notFound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error":"user not found"}`)
+	}))
+	defer notFound.Close()
+
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	registry := NewRegistry(httpClient)
+	cfg := NewConfig().WithCredentials(NewStaticCredentials("my_public_key", "my_private_key"))
+
+	africa, err := registry.Register("africa", cfg)
+	assert.Nil(t, err)
+	africa.BaseUrl = fakeService.URL
+
+	europe, err := registry.Register("europe", cfg)
+	assert.Nil(t, err)
+	europe.BaseUrl = notFound.URL
+
+	assert.Nil(t, cfg.HTTPClient)
+	assert.Equal(t, httpClient, africa.httpClient)
+	assert.Equal(t, httpClient, europe.httpClient)
+
+	_, err = registry.Register("africa", cfg)
+	assert.NotNil(t, err)
+
+	c, err := registry.Client("europe")
+	assert.Nil(t, err)
+	assert.Equal(t, europe, c)
+
+	_, err = registry.Client("asia")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []string{"africa", "europe"}, registry.Workspaces())
+
+	results := registry.AddEvent(fakeUser.Uid, &AddUserEvent{Event: "login"})
+	assert.Equal(t, []WorkspaceResult{{Workspace: "africa"}}, results)
 }
 
 // Config Tests
@@ -253,6 +1726,401 @@ func TestConfig_WithCredentials(t *testing.T) {
 	assert.Equal(t, "my_env_priv_key", cfg2.Credentials.privateKey)
 }
 
+func TestConfig_CredentialsProviders(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "credentials")
+	err := os.WriteFile(filename, []byte(`
+# engage.so workspaces
+[default]
+public_key = default_pub_key
+private_key = default_priv_key
+
+[europe]
+public_key = europe_pub_key
+private_key = europe_priv_key
+`), 0600)
+	assert.Nil(t, err)
+
+	credentials, err := NewFileProvider(filename, "europe").Retrieve()
+	assert.Nil(t, err)
+	assert.Equal(t, "europe_pub_key", credentials.publicKey)
+	assert.Equal(t, "europe_priv_key", credentials.privateKey)
+	assert.Equal(t, "file:"+filename, credentials.Source())
+
+	_, err = NewFileProvider(filename, "asia").Retrieve()
+	assert.NotNil(t, err)
+
+	os.Setenv("ENGAGE_SO_PUBLIC_KEY", "")
+	os.Setenv("ENGAGE_SO_PRIVATE_KEY", "")
+	chain := NewChainProvider(NewEnvProvider(), NewFileProvider(filename, ""), NewStaticCredentials("my_pub_key", "my_priv_key"))
+	credentials, err = chain.Retrieve()
+	assert.Nil(t, err)
+	assert.Equal(t, "default_pub_key", credentials.publicKey)
+	assert.Equal(t, "file:"+filename, credentials.Source())
+
+	chain = NewChainProvider(NewEnvProvider(), NewFileProvider(filepath.Join(t.TempDir(), "missing"), ""), NewStaticCredentials("", ""))
+	_, err = New(NewConfig().WithCredentialsProvider(chain))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "env: public key is required")
+	assert.Contains(t, err.Error(), "missing")
+	assert.Contains(t, err.Error(), "static: public key is required")
+
+	_, err = New(NewConfig())
+	assert.NotNil(t, err)
+}
+
+type countingProvider struct {
+	calls int32
+}
+
+func (p *countingProvider) Retrieve() (*Credentials, error) {
+	atomic.AddInt32(&p.calls, 1)
+	return NewStaticCredentials("my_pub_key", "my_priv_key"), nil
+}
+
+func TestConfig_CachedProvider(t *testing.T) {
+	provider := &countingProvider{}
+	cached := NewCachedProvider(provider, time.Hour)
+
+	for i := 0; i < 5; i++ {
+		_, err := cached.Retrieve()
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&provider.calls))
+
+	cached.Expire()
+	_, err := cached.Retrieve()
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&provider.calls))
+}
+
+func TestConfig_FileWatcherProviderRotation(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "credentials")
+	writeCredentials := func(publicKey string) {
+		tmp := filepath.Join(dir, "credentials.tmp")
+		content := fmt.Sprintf("[default]\npublic_key = %v\nprivate_key = my_priv_key\n", publicKey)
+		assert.Nil(t, os.WriteFile(tmp, []byte(content), 0600))
+		assert.Nil(t, os.Rename(tmp, filename))
+	}
+	writeCredentials("old_pub_key")
+
+	var lastKey atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		publicKey, _, _ := r.BasicAuth()
+		lastKey.Store(publicKey)
+		w.WriteHeader(200)
+		fmt.Fprintf(w, `{"uid":"%v"}`, fakeUser.Uid)
+	}))
+	defer server.Close()
+
+	c, err := New(NewConfig().WithCredentialsProvider(NewFileWatcherProvider(filename, "", 0)))
+	assert.Nil(t, err)
+	c.BaseUrl = server.URL
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, err := c.Users.Get(fakeUser.Uid)
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	writeCredentials("new_rotated_pub_key")
+	wg.Wait()
+
+	_, err = c.Users.Get(fakeUser.Uid)
+	assert.Nil(t, err)
+	assert.Equal(t, "new_rotated_pub_key", lastKey.Load())
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlFile := filepath.Join(dir, "engage.yaml")
+	assert.Nil(t, os.WriteFile(yamlFile, []byte(`
+base_url: https://eu.engage.example/v1
+user_agent: heroshe-test
+timeout: 3s
+retry:
+  max_retries: 2
+  min_backoff: 100ms
+  max_backoff: 1s
+rate_limit:
+  requests_per_second: 20
+  burst: 4
+credentials:
+  source: static
+  public_key: yaml_pub_key
+  private_key: yaml_priv_key
+`), 0600))
+
+	os.Setenv("ENGAGE_SO_USER_AGENT", "heroshe-env")
+	defer os.Unsetenv("ENGAGE_SO_USER_AGENT")
+
+	cfg, err := LoadConfig(yamlFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://eu.engage.example/v1", cfg.BaseUrl)
+	assert.Equal(t, "heroshe-env", cfg.UserAgent)
+	assert.Equal(t, 3*time.Second, cfg.Timeout)
+	assert.Equal(t, RetryPolicy{MaxRetries: 2, MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}, cfg.Retry)
+	assert.Equal(t, RateLimit{RequestsPerSecond: 20, Burst: 4}, cfg.RateLimit)
+
+	c, err := New(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://eu.engage.example/v1", c.BaseUrl)
+	assert.Equal(t, "heroshe-env", c.UserAgent)
+	assert.Equal(t, 3*time.Second, c.httpClient.Timeout)
+
+	jsonFile := filepath.Join(dir, "engage.json")
+	assert.Nil(t, os.WriteFile(jsonFile, []byte(`{
+		"base_url": "ftp://engage",
+		"timeout": "soon",
+		"retry": {"max_retries": -1, "min_backoff": "2s", "max_backoff": "1s"},
+		"credentials": {"source": "vault"}
+	}`), 0600))
+
+	_, err = LoadConfig(jsonFile)
+	configErr, ok := err.(*ConfigError)
+	assert.True(t, ok)
+	assert.Equal(t, 5, len(configErr.Problems))
+
+	assert.Nil(t, os.WriteFile(jsonFile, []byte(`{"unknown": true}`), 0600))
+	_, err = LoadConfig(jsonFile)
+	assert.NotNil(t, err)
+}
+
+func TestClient_Retry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(200)
+		fmt.Fprintf(w, `{"uid":"%v"}`, fakeUser.Uid)
+	}))
+	defer server.Close()
+
+	c := newTestClient(server.URL, NewConfig().WithRetry(RetryPolicy{MaxRetries: 2, MinBackoff: time.Millisecond}))
+	user, err := c.Users.UpdateAttributes(fakeUser.Uid, &UpdateUserAttributesInput{Number: Set("1234567890")})
+	assert.Nil(t, err)
+	assert.Equal(t, fakeUser.Uid, user.Uid)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// POST isn't idempotent, so server errors are not retried
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.Users.Create(&CreateUserInput{Id: fakeUser.Uid})
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestClient_RateLimited(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	// Rate limited requests of bulk operations are retried 3 times by default, by the client's retry loop only
+	c := newTestClient(server.URL, NewConfig())
+	start := time.Now()
+	output, err := c.Lists.BulkUnsubscribe(context.Background(), fakeList.Id, []string{fakeUser.Uid})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{fakeUser.Uid}, output.Failed())
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(3*time.Second))
+
+	// Other requests follow the retry policy, and every request waits for the delay asked by the API even when it
+	// isn't retried
+	start = time.Now()
+	_, err = c.Users.Get(fakeUser.Uid)
+	assert.NotNil(t, err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(900*time.Millisecond))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+}
+
+func TestClient_RateLimit(t *testing.T) {
+	c := newTestClient(fakeService.URL, NewConfig().WithRateLimit(RateLimit{RequestsPerSecond: 50, Burst: 1}))
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, err := c.Users.Get(fakeUser.Uid)
+		assert.Nil(t, err)
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(90*time.Millisecond))
+}
+
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestNewClient(t *testing.T) {
+	assert.NotPanics(t, func() {
+		_, err := New(nil)
+		assert.NotNil(t, err)
+
+		_, err = New(&Config{})
+		assert.NotNil(t, err)
+	})
+
+	httpClient := &http.Client{Timeout: time.Minute}
+	logger := &recordingLogger{}
+	c, err := NewClient(
+		WithCredentials(NewStaticCredentials("my_public_key", "my_private_key")),
+		WithHTTPClient(httpClient),
+		WithBaseUrl(fakeService.URL+"/"),
+		WithUserAgentSuffix("billing-service"),
+		WithTimeout(5*time.Second),
+		WithRetry(RetryPolicy{MaxRetries: 1, MinBackoff: time.Millisecond}),
+		WithLogger(logger),
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, fakeService.URL, c.BaseUrl)
+	assert.Equal(t, userAgent+" billing-service", c.UserAgent)
+	assert.Equal(t, 5*time.Second, c.httpClient.Timeout)
+	assert.Equal(t, time.Minute, httpClient.Timeout)
+
+	_, err = c.Users.Get("unknown")
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(logger.lines))
+
+	_, err = NewClient(WithCredentials(NewStaticCredentials("my_public_key", "my_private_key")), WithBaseUrl("engage.so"))
+	assert.NotNil(t, err)
+
+	_, err = NewClient(WithCredentials(nil))
+	assert.NotNil(t, err)
+
+	// Typed nil providers are configuration errors rather than falling back to other sources or panicking
+	_, err = NewClient(WithCredentials((*Credentials)(nil)))
+	assert.NotNil(t, err)
+	_, err = NewClient(WithCredentials((*ChainProvider)(nil)))
+	assert.NotNil(t, err)
+	_, err = New(&Config{CredentialsProvider: (*Credentials)(nil)})
+	assert.NotNil(t, err)
+
+	_, err = NewClient(WithTimeout(-time.Second))
+	assert.NotNil(t, err)
+}
+
+func TestClient_MaxResponseSize(t *testing.T) {
+	var calls int32
+	user, _ := json.Marshal(fakeUser)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Length", fmt.Sprint(len(user)))
+		w.Write(user)
+	}))
+	defer server.Close()
+
+	// Flushing before the handler returns makes the response chunked, so its length is unknown
+	chunked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(user)
+		w.(http.Flusher).Flush()
+	}))
+	defer chunked.Close()
+
+	// A response that is too large is the same when the request is sent again, so it isn't retried
+	small := newTestClient(server.URL, NewConfig().WithMaxResponseSize(64).
+		WithRetry(RetryPolicy{MaxRetries: 2, MinBackoff: time.Millisecond}))
+	_, err := small.Users.Get(fakeUser.Uid)
+	assert.Equal(t, ErrResponseTooLarge, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	small.BaseUrl = chunked.URL
+	_, err = small.Users.Get(fakeUser.Uid)
+	assert.True(t, errors.Is(err, ErrResponseTooLarge))
+
+	exact := newTestClient(chunked.URL, NewConfig().WithMaxResponseSize(int64(len(user))))
+	output, err := exact.Users.Get(fakeUser.Uid)
+	assert.Nil(t, err)
+	assert.Equal(t, fakeUser.Email, output.Email)
+
+	// Neither is a response that isn't valid JSON
+	var invalidCalls int32
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&invalidCalls, 1)
+		w.Write([]byte(`{"uid": `))
+	}))
+	defer invalid.Close()
+
+	small.BaseUrl = invalid.URL
+	_, err = small.Users.Get(fakeUser.Uid)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&invalidCalls))
+}
+
+func TestClient_Gzip(t *testing.T) {
+	var compressedRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			atomic.AddInt32(&compressedRequests, 1)
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+
+		var input map[string]interface{}
+		if r.Method == http.MethodPut {
+			if err := json.NewDecoder(body).Decode(&input); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+
+		user := fakeUser
+		if number, ok := input["number"].(string); ok {
+			user.Number = number
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		json.NewEncoder(gz).Encode(user)
+		gz.Close()
+	}))
+	defer server.Close()
+
+	httpClient := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	c := newTestClient(server.URL, NewConfig().WithHttpClient(httpClient).WithGzipRequestThreshold(256))
+
+	user, err := c.Users.Get(fakeUser.Uid)
+	assert.Nil(t, err)
+	assert.Equal(t, fakeUser.Email, user.Email)
+
+	// Small payloads are sent as is
+	user, err = c.Users.UpdateAttributes(fakeUser.Uid, &UpdateUserAttributesInput{Number: Set("1234567890")})
+	assert.Nil(t, err)
+	assert.Equal(t, "1234567890", user.Number)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&compressedRequests))
+
+	user, err = c.Users.UpdateAttributes(fakeUser.Uid, &UpdateUserAttributesInput{
+		Number: Set("0987654321"),
+		Meta:   map[string]interface{}{"bio": strings.Repeat("Heroshe ", 64)},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "0987654321", user.Number)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&compressedRequests))
+}
+
 func TestConfig_WithHttpClient(t *testing.T) {
 	d := 10 * time.Second
 
@@ -263,7 +2131,14 @@ func TestConfig_WithHttpClient(t *testing.T) {
 	assert.Equal(t, d, cfg.HTTPClient.Timeout)
 }
 
-//StartServer initializes a test HTTP server useful for request mocking
+// newTestClient returns a client built from cfg that sends its requests to baseUrl
+func newTestClient(baseUrl string, cfg *Config) *Client {
+	c, _ := New(cfg.WithCredentials(NewStaticCredentials("my_public_key", "my_private_key")))
+	c.BaseUrl = baseUrl
+	return c
+}
+
+// StartServer initializes a test HTTP server useful for request mocking
 func fakeServer() *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-type", "application/json")
@@ -306,8 +2181,19 @@ func fakeServer() *httptest.Server {
 				updatedUserJson, _ := json.Marshal(updatedUser)
 				w.WriteHeader(200)
 				fmt.Fprintf(w, string(updatedUserJson))
+			case http.MethodDelete:
+				w.WriteHeader(200)
+				fmt.Fprintf(w, `{"status":"ok"}`)
 			}
 
+		case fmt.Sprintf("/users/%v/devices/%v", fakeUser.Uid, fakeUser.Devices[0].Token):
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"status":"ok"}`)
+
+		case "/users/merge":
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"status":"queued","url":"https://api.engage.so/v1/users/merge/123"}`)
+
 		case fmt.Sprintf("/users/%v/events", fakeUser.Uid):
 			w.WriteHeader(200)
 			fmt.Fprintf(w, `{"status":"ok"}`)
@@ -341,7 +2227,32 @@ func fakeServer() *httptest.Server {
 
 			}
 
-		case fmt.Sprintf("/lists/%v/subscribers/%v", fakeList.Id, fakeUser.Uid):
+		case fmt.Sprintf("/lists/%v/subscribers", fakeList.Id):
+			if r.Method == http.MethodPost {
+				w.WriteHeader(200)
+				fmt.Fprintf(w, `{"uid":"%v"}`, fakeUser.Uid)
+				return
+			}
+
+			if r.URL.Query().Get("limit") != "2" {
+				w.WriteHeader(400)
+				return
+			}
+
+			confirmedAt := time.Now().UTC()
+			subscribers, _ := json.Marshal(ListSubscribersOutput{
+				Data: []*ListSubscriberOutput{
+					{Uid: fakeUser.Uid, Email: fakeUser.Email, Subscribed: true, SubscribedAt: confirmedAt, ConfirmedAt: &confirmedAt},
+					{Uid: "987654321", Email: "pending@heroshe.com", Subscribed: true, SubscribedAt: confirmedAt},
+				},
+				NextCursor: "cursor_2",
+			})
+			w.WriteHeader(200)
+			fmt.Fprintf(w, string(subscribers))
+
+		case fmt.Sprintf("/lists/%v/subscribers/%v", fakeList.Id, fakeUser.Uid),
+			fmt.Sprintf("/lists/%v/subscribers/%v", fakeUser.Lists[0].Id, fakeUser.Uid),
+			fmt.Sprintf("/lists/%v/subscribers/%v", fakeUser.Lists[1].Id, fakeUser.Uid):
 			w.WriteHeader(200)
 			fmt.Fprintf(w, `{"status": "ok"}`)
 
@@ -350,3 +2261,92 @@ func fakeServer() *httptest.Server {
 		}
 	}))
 }
+
+// Benchmarks
+
+func benchmarkUsersList(b *testing.B, pageSize int) {
+	page := ListUserOutput{NextCursor: "cursor_2"}
+	for i := 0; i < pageSize; i++ {
+		user := fakeUser
+		page.Data = append(page.Data, &user)
+	}
+	body, _ := json.Marshal(page)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	c := newTestClient(server.URL, NewConfig())
+	input := &PaginatorInput{Limit: Int(pageSize)}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Users.List(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUsers_List10(b *testing.B)   { benchmarkUsersList(b, 10) }
+func BenchmarkUsers_List100(b *testing.B)  { benchmarkUsersList(b, 100) }
+func BenchmarkUsers_List1000(b *testing.B) { benchmarkUsersList(b, 1000) }
+
+// benchmarkDecode compares decode, which unmarshals from a pooled buffer, with streaming through json.Decoder
+func benchmarkDecode(b *testing.B, pageSize int, stream bool) {
+	page := ListUserOutput{NextCursor: "cursor_2"}
+	for i := 0; i < pageSize; i++ {
+		user := fakeUser
+		page.Data = append(page.Data, &user)
+	}
+	body, _ := json.Marshal(page)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var output ListUserOutput
+		var err error
+		if stream {
+			err = json.NewDecoder(bytes.NewReader(body)).Decode(&output)
+		} else {
+			err = decode(bytes.NewReader(body), int64(len(body)), &output)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecode_Buffered10(b *testing.B)   { benchmarkDecode(b, 10, false) }
+func BenchmarkDecode_Stream10(b *testing.B)     { benchmarkDecode(b, 10, true) }
+func BenchmarkDecode_Buffered100(b *testing.B)  { benchmarkDecode(b, 100, false) }
+func BenchmarkDecode_Stream100(b *testing.B)    { benchmarkDecode(b, 100, true) }
+func BenchmarkDecode_Buffered1000(b *testing.B) { benchmarkDecode(b, 1000, false) }
+func BenchmarkDecode_Stream1000(b *testing.B)   { benchmarkDecode(b, 1000, true) }
+
+func BenchmarkUsers_UpdateAttributes(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Write([]byte(`{"uid":"123456789"}`))
+	}))
+	defer server.Close()
+
+	c := newTestClient(server.URL, NewConfig())
+	meta := map[string]interface{}{}
+	for i := 0; i < 50; i++ {
+		meta[fmt.Sprintf("property_%v", i)] = strings.Repeat("value", 10)
+	}
+	input := &UpdateUserAttributesInput{Number: Set("1234567890"), Meta: meta}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Users.UpdateAttributes(fakeUser.Uid, input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,6 +1,14 @@
 package goengage
 
-import "time"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
 
 type (
 	CreateUserInput struct {
@@ -16,16 +24,33 @@ type (
 		Meta           map[string]interface{} `json:"meta,omitempty"`
 	}
 
+	// UpdateUserAttributesInput only sends the attributes that are set. FirstName, LastName, Email and Number can be
+	// cleared with Null, and Meta keys can be removed by listing them in DeleteMeta.
 	UpdateUserAttributesInput struct {
-		FirstName      *string                `json:"first_name,omitempty"`
-		LastName       *string                `json:"last_name,omitempty"`
-		Email          *string                `json:"email,omitempty"`
-		Number         *string                `json:"number,omitempty"`
+		FirstName      Optional[string]       `json:"first_name"`
+		LastName       Optional[string]       `json:"last_name"`
+		Email          Optional[string]       `json:"email"`
+		Number         Optional[string]       `json:"number"`
 		Lists          []string               `json:"lists,omitempty"`
 		DeviceToken    *string                `json:"device_token,omitempty"`
 		DevicePlatform *string                `json:"device_platform,omitempty"`
 		CreatedAt      *time.Time             `json:"created_at,omitempty"`
 		Meta           map[string]interface{} `json:"meta,omitempty"`
+		// DeleteMeta lists Meta keys to remove from the user. A key can't be both set in Meta and deleted.
+		DeleteMeta []string `json:"-"`
+		// IfMatch is an ETag from UserOutput. When set, the update is rejected with a *ConflictError if the user
+		// changed since that ETag was read.
+		IfMatch string `json:"-"`
+	}
+
+	mergeUserInput struct {
+		Source      string `json:"source"`
+		Destination string `json:"destination"`
+	}
+
+	AddDeviceInput struct {
+		Token    string         `json:"device_token"`
+		Platform DevicePlatform `json:"device_platform"`
 	}
 
 	PaginatorInput struct {
@@ -39,6 +64,15 @@ type (
 		Value      interface{}            `json:"value,omitempty"`
 		Properties map[string]interface{} `json:"properties,omitempty"`
 		Timestamp  *time.Time             `json:"timestamp,omitempty"`
+		// IdempotencyKey identifies the event so sending it twice records it once. It is sent as the Idempotency-Key
+		// header, and duplicates are skipped on the client side when Config.Dedup is set.
+		IdempotencyKey string `json:"-"`
+	}
+
+	// UserEvent is an event of a specific user, sent with Users.AddEvents
+	UserEvent struct {
+		Uid string `json:"uid"`
+		AddUserEvent
 	}
 
 	CreateUpdateListInput struct {
@@ -46,6 +80,9 @@ type (
 		Description *string `json:"description,omitempty"`
 		RedirectUrl *string `json:"redirect_url,omitempty"`
 		DoubleOptIn *bool   `json:"double_optin,omitempty"`
+		// IfMatch is an ETag from ListOutput. When set, the update is rejected with a *ConflictError if the list
+		// changed since that ETag was read.
+		IfMatch string `json:"-"`
 	}
 
 	SubscribeListInput struct {
@@ -58,6 +95,97 @@ type (
 	}
 )
 
+// updateUserAttributes is the wire format of UpdateUserAttributesInput. Its fields shadow the embedded ones so unset
+// Optionals are left out and deleted Meta keys are sent as null.
+type updateUserAttributes struct {
+	FirstName *Optional[string]      `json:"first_name,omitempty"`
+	LastName  *Optional[string]      `json:"last_name,omitempty"`
+	Email     *Optional[string]      `json:"email,omitempty"`
+	Number    *Optional[string]      `json:"number,omitempty"`
+	Meta      map[string]interface{} `json:"meta,omitempty"`
+	*updateUserAttributesFields
+}
+
+type updateUserAttributesFields UpdateUserAttributesInput
+
+// MarshalJSON encodes only the attributes that were set, with null for cleared attributes and deleted Meta keys
+func (i UpdateUserAttributesInput) MarshalJSON() ([]byte, error) {
+	meta := i.Meta
+	if len(i.DeleteMeta) > 0 {
+		meta = make(map[string]interface{}, len(i.Meta)+len(i.DeleteMeta))
+		for k, v := range i.Meta {
+			meta[k] = v
+		}
+
+		for _, k := range i.DeleteMeta {
+			if _, ok := i.Meta[k]; ok {
+				return nil, fmt.Errorf("goengage: meta key %q can't be both set and deleted", k)
+			}
+			meta[k] = nil
+		}
+	}
+
+	return json.Marshal(updateUserAttributes{
+		FirstName:                  i.FirstName.ptr(),
+		LastName:                   i.LastName.ptr(),
+		Email:                      i.Email.ptr(),
+		Number:                     i.Number.ptr(),
+		Meta:                       meta,
+		updateUserAttributesFields: (*updateUserAttributesFields)(&i),
+	})
+}
+
+// UnmarshalJSON is the inverse of MarshalJSON. Meta keys that are null are moved to DeleteMeta.
+func (i *UpdateUserAttributesInput) UnmarshalJSON(data []byte) error {
+	var fields updateUserAttributesFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	*i = UpdateUserAttributesInput(fields)
+	i.Meta, i.DeleteMeta = nil, nil
+	for k, v := range fields.Meta {
+		if v == nil {
+			i.DeleteMeta = append(i.DeleteMeta, k)
+			continue
+		}
+
+		if i.Meta == nil {
+			i.Meta = map[string]interface{}{}
+		}
+		i.Meta[k] = v
+	}
+	sort.Strings(i.DeleteMeta)
+
+	return nil
+}
+
+// values converts the paginator into the query parameters expected by paginated endpoints
+func (p *PaginatorInput) values() (url.Values, error) {
+	params := url.Values{}
+	if p == nil {
+		return params, nil
+	}
+
+	if p.NextCursor != nil && p.PrevCursor != nil {
+		return nil, errors.New("goengage: Cannot use Next and Prev cursor at the same time")
+	}
+
+	if p.Limit != nil {
+		params.Add("limit", strconv.Itoa(*p.Limit))
+	}
+
+	if p.NextCursor != nil {
+		params.Add("next_cursor", *p.NextCursor)
+	}
+
+	if p.PrevCursor != nil {
+		params.Add("prev_cursor", *p.PrevCursor)
+	}
+
+	return params, nil
+}
+
 func String(input string) *string {
 	return &input
 }
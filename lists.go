@@ -1,13 +1,10 @@
 package goengage
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
-	"strconv"
 	"time"
 )
 
@@ -20,6 +17,13 @@ type (
 		ArchiveList(id string) error
 		SubscribeList(id string, input *SubscribeListInput) (*SubscribeListOutput, error)
 		UnsubscribeList(id, uid string) error
+		ListSubscribers(id string, input *PaginatorInput) (*ListSubscribersOutput, error)
+		IsSubscribed(id, uid string) (bool, error)
+		BulkSubscribe(ctx context.Context, id string, inputs []SubscribeListInput) (*BulkSubscribeOutput, error)
+		BulkUnsubscribe(ctx context.Context, id string, uids []string) (*BulkUnsubscribeOutput, error)
+		ConfirmSubscription(id, uid string) error
+		PendingConfirmations(id string, input *PaginatorInput) (*ListSubscribersOutput, error)
+		ResendConfirmation(id, uid string) error
 	}
 
 	Lists service
@@ -33,6 +37,10 @@ type (
 		DoubleOptIn     bool      `json:"double_optin"`
 		RedirectUrl     string    `json:"redirect_url"`
 		CreatedAt       time.Time `json:"created_at"`
+		// ETag and LastModified are the validators returned by the API, if any. Pass ETag as
+		// CreateUpdateListInput.IfMatch to only update the list if it hasn't changed since.
+		ETag         string `json:"-"`
+		LastModified string `json:"-"`
 	}
 	AllListOutput struct {
 		Data       []*ListOutput `json:"data"`
@@ -42,6 +50,27 @@ type (
 	SubscribeListOutput struct {
 		Uid string `json:"uid"`
 	}
+	ListSubscriberOutput struct {
+		Uid            string     `json:"uid"`
+		FirstName      string     `json:"first_name"`
+		LastName       string     `json:"last_name"`
+		Email          string     `json:"email"`
+		Number         string     `json:"number"`
+		Subscribed     bool       `json:"subscribed"`
+		SubscribedAt   time.Time  `json:"subscribed_at"`
+		ConfirmedAt    *time.Time `json:"confirmed_at"`
+		UnsubscribedAt *time.Time `json:"unsubscribed_at"`
+	}
+	ListSubscribersOutput struct {
+		Data       []*ListSubscriberOutput `json:"data"`
+		NextCursor string                  `json:"next_cursor"`
+		PrevCursor string                  `json:"prev_cursor"`
+	}
+
+	// contextListSubscriber is implemented by Lists so callers with a context can pass it through to the request
+	contextListSubscriber interface {
+		subscribeList(ctx context.Context, id string, input *SubscribeListInput) (*SubscribeListOutput, error)
+	}
 )
 
 // CreateList creates a new list using the provided input - Documentation Link: https://engage.so/docs/api/lists#create-a-list
@@ -50,12 +79,13 @@ func (l *Lists) CreateList(input *CreateUpdateListInput) (*ListOutput, error) {
 		return nil, errors.New("goengage: title is required")
 	}
 
-	payload, err := json.Marshal(input)
+	payload, err := encode(input)
 	if err != nil {
 		return nil, err
 	}
+	defer payload.release()
 
-	req, err := l.client.newRequest(http.MethodPost, "/lists", bytes.NewReader(payload))
+	req, err := l.client.newRequest(http.MethodPost, "/lists", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -71,22 +101,9 @@ func (l *Lists) CreateList(input *CreateUpdateListInput) (*ListOutput, error) {
 
 // GetAllLists returns as array of lists - Documentation Link: https://engage.so/docs/api/lists#get-all-list-data
 func (l *Lists) GetAllLists(input *PaginatorInput) (*AllListOutput, error) {
-
-	if input.NextCursor != nil && input.PrevCursor != nil {
-		return nil, errors.New("goengage: Cannot use Next and Prev cursor at the same time")
-	}
-
-	params := url.Values{}
-	if input.Limit != nil {
-		params.Add("limit", strconv.Itoa(*input.Limit))
-	}
-
-	if input.NextCursor != nil && input.PrevCursor == nil {
-		params.Add("next_cursor", *input.NextCursor)
-	}
-
-	if input.PrevCursor != nil && input.NextCursor == nil {
-		params.Add("prev_cursor", *input.PrevCursor)
+	params, err := input.values()
+	if err != nil {
+		return nil, err
 	}
 
 	req, err := l.client.newRequest(http.MethodGet, fmt.Sprintf("/lists?%v", params.Encode()), nil)
@@ -105,39 +122,59 @@ func (l *Lists) GetAllLists(input *PaginatorInput) (*AllListOutput, error) {
 
 // GetList retrieves the details of a list using it's ID - Documentation Link: https://engage.so/docs/api/lists#get-all-list-data
 func (l *Lists) GetList(id string) (*ListOutput, error) {
+	output, _, err := l.getListIfModified(id, nil)
+	return output, err
+}
+
+// getListIfModified fetches the list unless it hasn't changed since cached was fetched, in which case cached is
+// returned along with true. cached can be nil.
+func (l *Lists) getListIfModified(id string, cached *ListOutput) (*ListOutput, bool, error) {
 	if id == "" {
-		return nil, errors.New("goengage: id is required")
+		return nil, false, errors.New("goengage: id is required")
 	}
 
 	req, err := l.client.newRequest(http.MethodGet, fmt.Sprintf("/lists/%v", id), nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	if cached != nil {
+		setConditionalHeaders(req, cached.ETag, cached.LastModified)
 	}
 
 	var output ListOutput
-	err = l.client.makeRequest(req, &output)
+	header, err := l.client.sendRequest(req, &output)
+	if errors.Is(err, errNotModified) && cached != nil {
+		return cached, true, nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return &output, err
+	output.ETag = header.Get("ETag")
+	output.LastModified = header.Get("Last-Modified")
+	return &output, false, err
 }
 
-// UpdateList updates properties of the list - Documentation Link: https://engage.so/docs/api/lists#update-a-list
+// UpdateList updates properties of the list. A *ConflictError is returned when IfMatch is set and the list changed
+// since it was read. - Documentation Link: https://engage.so/docs/api/lists#update-a-list
 func (l *Lists) UpdateList(id string, input *CreateUpdateListInput) (*ListOutput, error) {
 	if id == "" {
 		return nil, errors.New("goengage: id is required")
 	}
 
-	payload, err := json.Marshal(input)
+	payload, err := encode(input)
 	if err != nil {
 		return nil, err
 	}
+	defer payload.release()
 
-	req, err := l.client.newRequest(http.MethodPut, fmt.Sprintf("/lists/%v", id), bytes.NewReader(payload))
+	req, err := l.client.newRequest(http.MethodPut, fmt.Sprintf("/lists/%v", id), payload)
 	if err != nil {
 		return nil, err
 	}
+	if input != nil && input.IfMatch != "" {
+		req.Header.Set("If-Match", input.IfMatch)
+	}
 
 	var output ListOutput
 	err = l.client.makeRequest(req, &output)
@@ -165,6 +202,10 @@ func (l *Lists) ArchiveList(id string) error {
 
 // SubscribeList creates a user and subscribes to a list - Documentation Link: https://engage.so/docs/api/lists#subscribe-to-a-list
 func (l *Lists) SubscribeList(id string, input *SubscribeListInput) (*SubscribeListOutput, error) {
+	return l.subscribeList(context.Background(), id, input)
+}
+
+func (l *Lists) subscribeList(ctx context.Context, id string, input *SubscribeListInput) (*SubscribeListOutput, error) {
 	if input.Email == nil && input.Number == nil {
 		return nil, errors.New("goengage: Email or Number is required")
 	}
@@ -173,12 +214,13 @@ func (l *Lists) SubscribeList(id string, input *SubscribeListInput) (*SubscribeL
 		return nil, errors.New("goengage: id is required")
 	}
 
-	payload, err := json.Marshal(input)
+	payload, err := encode(input)
 	if err != nil {
 		return nil, err
 	}
+	defer payload.release()
 
-	req, err := l.client.newRequest(http.MethodPost, fmt.Sprintf("/lists/%v/subscribers", id), bytes.NewReader(payload))
+	req, err := l.client.newRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("/lists/%v/subscribers", id), payload)
 	if err != nil {
 		return nil, err
 	}
@@ -192,17 +234,29 @@ func (l *Lists) SubscribeList(id string, input *SubscribeListInput) (*SubscribeL
 	return &output, err
 }
 
+// subscribeListContext subscribes to the list through lists, passing ctx through when lists supports it
+func subscribeListContext(ctx context.Context, lists ListService, id string, input *SubscribeListInput) (*SubscribeListOutput, error) {
+	if subscriber, ok := lists.(contextListSubscriber); ok {
+		return subscriber.subscribeList(ctx, id, input)
+	}
+	return lists.SubscribeList(id, input)
+}
+
 // UnsubscribeList Remove subscribers from list. - Documentation Link: https://engage.so/docs/api/lists#unsubscribe-from-a-list
 func (l *Lists) UnsubscribeList(id, uid string) error {
+	return l.unsubscribeList(context.Background(), id, uid)
+}
+
+func (l *Lists) unsubscribeList(ctx context.Context, id, uid string) error {
 	if id == "" {
 		return errors.New("goengage: id is required")
 	}
 
-	if id == "" {
+	if uid == "" {
 		return errors.New("goengage: uid is required")
 	}
 
-	req, err := l.client.newRequest(http.MethodDelete, fmt.Sprintf("/lists/%v/subscribers/%v", id, uid), nil)
+	req, err := l.client.newRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("/lists/%v/subscribers/%v", id, uid), nil)
 	if err != nil {
 		return err
 	}
@@ -210,3 +264,101 @@ func (l *Lists) UnsubscribeList(id, uid string) error {
 	var output map[string]string
 	return l.client.makeRequest(req, &output)
 }
+
+// ListSubscribers returns a page of the list's subscribers along with their subscription status. ConfirmedAt is nil
+// for subscribers of a double opt-in list that have not confirmed their subscription yet.
+func (l *Lists) ListSubscribers(id string, input *PaginatorInput) (*ListSubscribersOutput, error) {
+	if id == "" {
+		return nil, errors.New("goengage: id is required")
+	}
+
+	params, err := input.values()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := l.client.newRequest(http.MethodGet, fmt.Sprintf("/lists/%v/subscribers?%v", id, params.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var output ListSubscribersOutput
+	err = l.client.makeRequest(req, &output)
+	if err != nil {
+		return nil, err
+	}
+
+	return &output, err
+}
+
+// IsSubscribed reports whether the user is an active subscriber of the list
+func (l *Lists) IsSubscribed(id, uid string) (bool, error) {
+	if id == "" {
+		return false, errors.New("goengage: id is required")
+	}
+
+	user, err := l.client.Users.Get(uid)
+	if err != nil {
+		return false, err
+	}
+
+	for _, list := range user.Lists {
+		if list.Id == id {
+			return list.Subscribed, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ConfirmSubscription marks a pending double opt-in subscription as confirmed by adding the list to the user
+func (l *Lists) ConfirmSubscription(id, uid string) error {
+	if id == "" {
+		return errors.New("goengage: id is required")
+	}
+
+	_, err := l.client.Users.UpdateAttributes(uid, &UpdateUserAttributesInput{
+		Lists: []string{id},
+	})
+	return err
+}
+
+// PendingConfirmations returns the subscribers in a page of ListSubscribers that have not confirmed their subscription.
+// Because the filtering happens on each page, a page can hold fewer subscribers than the requested limit while
+// NextCursor still points to more results.
+func (l *Lists) PendingConfirmations(id string, input *PaginatorInput) (*ListSubscribersOutput, error) {
+	output, err := l.ListSubscribers(id, input)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := output.Data[:0]
+	for _, subscriber := range output.Data {
+		if subscriber.Subscribed && subscriber.ConfirmedAt == nil {
+			pending = append(pending, subscriber)
+		}
+	}
+	output.Data = pending
+
+	return output, nil
+}
+
+// ResendConfirmation subscribes the user to the list again, which makes engage.so send a new confirmation message
+// for double opt-in lists.
+func (l *Lists) ResendConfirmation(id, uid string) error {
+	user, err := l.client.Users.Get(uid)
+	if err != nil {
+		return err
+	}
+
+	input := &SubscribeListInput{}
+	if user.Email != "" {
+		input.Email = String(user.Email)
+	}
+	if user.Number != "" {
+		input.Number = String(user.Number)
+	}
+
+	_, err = l.SubscribeList(id, input)
+	return err
+}
@@ -0,0 +1,284 @@
+package goengage
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// MetaFieldError is returned when a Meta value doesn't match the type of the struct field it maps to
+type MetaFieldError struct {
+	Field    string
+	Expected string
+	Value    interface{}
+}
+
+// GetAs fetches a user and decodes their Meta into T. See DecodeMeta for how fields are mapped.
+//
+//	type Profile struct {
+//		Plan      string     `engage:"plan"`
+//		Orders    int        `engage:"orders"`
+//		ChurnedAt *time.Time `engage:"churned_at"`
+//	}
+//
+//	user, profile, err := goengage.GetAs[Profile](client.Users, "user_uid")
+func GetAs[T any](users UserService, uid string) (*UserOutput, T, error) {
+	var meta T
+
+	user, err := users.Get(uid)
+	if err != nil {
+		return nil, meta, err
+	}
+
+	meta, err = DecodeMeta[T](user.Meta)
+	if err != nil {
+		return nil, meta, err
+	}
+	return user, meta, nil
+}
+
+// UpdateMetaAs writes the fields of meta to the user's Meta. See MetaOf for how fields are mapped; keys of nil pointer
+// fields are left unchanged.
+func UpdateMetaAs[T any](users UserService, uid string, meta T) (*UserOutput, error) {
+	values, err := MetaOf(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return users.UpdateAttributes(uid, &UpdateUserAttributesInput{Meta: values})
+}
+
+// DecodeMeta decodes Meta into the struct T. Fields are mapped using their `engage:"name"` tag; untagged fields and
+// fields tagged `engage:"-"` are ignored. Supported field types are strings, bools, integers, floats, time.Time
+// (from RFC 3339 strings) and pointers to them. Keys missing from Meta or set to null leave the field untouched.
+// Numbers are range checked, so a value that doesn't fit the field, or a fraction for an integer field, is an error.
+func DecodeMeta[T any](meta map[string]interface{}) (T, error) {
+	var output T
+
+	v := reflect.ValueOf(&output).Elem()
+	if v.Kind() != reflect.Struct {
+		return output, fmt.Errorf("goengage: meta can only be decoded into a struct, not %v", v.Type())
+	}
+
+	for _, field := range metaFields(v.Type()) {
+		value, ok := meta[field.name]
+		if !ok || value == nil {
+			continue
+		}
+
+		if err := setMetaValue(v.FieldByIndex(field.index), field.name, value); err != nil {
+			return output, err
+		}
+	}
+
+	return output, nil
+}
+
+// MetaOf builds a Meta map from the struct meta, or a pointer to one, using the same field mapping as DecodeMeta.
+// Fields tagged with the omitempty option, e.g. `engage:"plan,omitempty"`, are left out when they hold their zero
+// value. Nil pointer fields are always left out, as a null Meta value deletes the key; list keys in
+// UpdateUserAttributesInput.DeleteMeta to remove them. Fields of unsupported types are rejected so only values
+// engage.so can store are sent.
+func MetaOf[T any](meta T) (map[string]interface{}, error) {
+	v := reflect.ValueOf(meta)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("goengage: meta can only be built from a struct, not %v", v.Type())
+	}
+
+	values := map[string]interface{}{}
+	for _, field := range metaFields(v.Type()) {
+		fv := v.FieldByIndex(field.index)
+		if !isSupportedMetaType(fv.Type()) {
+			return nil, &MetaFieldError{Field: field.name, Expected: "string, bool, number or time", Value: fv.Interface()}
+		}
+
+		if field.omitEmpty && fv.IsZero() {
+			continue
+		}
+
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+
+		if fv.Type() == timeType {
+			values[field.name] = fv.Interface().(time.Time).Format(time.RFC3339)
+			continue
+		}
+		values[field.name] = fv.Interface()
+	}
+
+	return values, nil
+}
+
+type metaField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// metaFields returns the tagged fields of t. A field tagged with the value option holds the value of an event rather
+// than a property, so it is left out.
+func metaFields(t reflect.Type) []metaField {
+	var fields []metaField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("engage")
+		if !ok || tag == "-" || f.PkgPath != "" {
+			continue
+		}
+
+		field, isValue := parseMetaTag(f, tag)
+		if !isValue {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// eventValueField returns the field of t tagged with the value option, e.g. `engage:",value"`
+func eventValueField(t reflect.Type) ([]int, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("engage")
+		if !ok || tag == "-" || f.PkgPath != "" {
+			continue
+		}
+
+		if _, isValue := parseMetaTag(f, tag); isValue {
+			return f.Index, true
+		}
+	}
+	return nil, false
+}
+
+// parseMetaTag parses an engage tag and reports whether it has the value option
+func parseMetaTag(f reflect.StructField, tag string) (metaField, bool) {
+	parts := strings.Split(tag, ",")
+	field := metaField{name: parts[0], index: f.Index}
+	if field.name == "" {
+		field.name = f.Name
+	}
+
+	isValue := false
+	for _, option := range parts[1:] {
+		switch option {
+		case "omitempty":
+			field.omitEmpty = true
+		case "value":
+			isValue = true
+		}
+	}
+	return field, isValue
+}
+
+func isSupportedMetaType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return true
+	}
+
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// setMetaValue converts a value decoded from JSON into the type of field
+func setMetaValue(field reflect.Value, name string, value interface{}) error {
+	if field.Kind() == reflect.Ptr {
+		ptr := reflect.New(field.Type().Elem())
+		if err := setMetaValue(ptr.Elem(), name, value); err != nil {
+			return err
+		}
+		field.Set(ptr)
+		return nil
+	}
+
+	mismatch := func(expected string) error {
+		return &MetaFieldError{Field: name, Expected: expected, Value: value}
+	}
+
+	if field.Type() == timeType {
+		s, ok := value.(string)
+		if !ok {
+			return mismatch("RFC 3339 time")
+		}
+
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return mismatch("RFC 3339 time")
+		}
+		field.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return mismatch("string")
+		}
+		field.SetString(s)
+
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return mismatch("bool")
+		}
+		field.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := value.(float64)
+		// float64(math.MaxInt64) rounds up to 2^63, which is out of range, and bounds are checked before converting
+		// as out of range conversions are implementation defined
+		if !ok || n != math.Trunc(n) || n >= math.MaxInt64 || n < math.MinInt64 || field.OverflowInt(int64(n)) {
+			return mismatch(field.Type().String())
+		}
+		field.SetInt(int64(n))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := value.(float64)
+		// Likewise float64(math.MaxUint64) is 2^64
+		if !ok || n != math.Trunc(n) || n < 0 || n >= math.MaxUint64 || field.OverflowUint(uint64(n)) {
+			return mismatch(field.Type().String())
+		}
+		field.SetUint(uint64(n))
+
+	case reflect.Float32, reflect.Float64:
+		n, ok := value.(float64)
+		if !ok || field.OverflowFloat(n) {
+			return mismatch(field.Type().String())
+		}
+		field.SetFloat(n)
+
+	default:
+		return fmt.Errorf("goengage: meta field %v has unsupported type %v", name, field.Type())
+	}
+
+	return nil
+}
+
+func (e *MetaFieldError) Error() string {
+	return fmt.Sprintf("goengage: meta field %v: expected %v, got %T %v", e.Field, e.Expected, e.Value, e.Value)
+}
@@ -0,0 +1,324 @@
+package goengage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTrackingEvent     = "request"
+	defaultTrackingQueueSize = 1000
+	defaultTrackingTimeout   = 10 * time.Second
+	defaultLastSeenInterval  = time.Hour
+	lastSeenCacheSize        = 10000
+)
+
+// ErrTrackingQueueFull is reported to TrackingMiddleware.OnError for requests dropped because the queue was full
+var ErrTrackingQueueFull = errors.New("goengage: tracking queue is full")
+
+type (
+	// TrackingMiddleware records an event for every request made by an identified user, with the route, method,
+	// status and latency (in milliseconds) as properties, and can keep a "last seen" time in the user's Meta.
+	//
+	// Requests are handed to background workers through a bounded queue, so the wrapped handler is never slowed down
+	// or failed by tracking: when the queue is full the request isn't tracked, and errors are only reported to
+	// OnError. Call Close to flush the queue on shutdown.
+	TrackingMiddleware struct {
+		Users UserService
+		// UserId returns the uid of the user making the request, typically from the request context set by the
+		// authentication middleware. Requests with an empty uid are not tracked.
+		UserId func(r *http.Request) string
+		// Event is the name of the event. Defaults to "request".
+		Event string
+		// Route returns the route property. Defaults to the URL path; return the route pattern instead to keep the
+		// number of distinct values low.
+		Route func(r *http.Request) string
+		// Sample returns the fraction of requests like r, between 0 and 1, to record an event for. Every request is
+		// recorded when nil.
+		Sample func(r *http.Request, status int) float64
+		// LastSeenField is the Meta key set to the time of the user's latest request, such as "last_seen_at". It is
+		// updated regardless of sampling, at most once per LastSeenInterval for each user. Nothing is updated when empty.
+		LastSeenField string
+		// LastSeenInterval defaults to 1 hour
+		LastSeenInterval time.Duration
+		// QueueSize is the number of requests waiting to be sent before new ones are dropped. Defaults to 1000.
+		QueueSize int
+		// Workers is the number of goroutines sending events. Defaults to 1.
+		Workers int
+		// Timeout bounds each call to the API, retries included. Defaults to 10 seconds.
+		Timeout time.Duration
+		// OnError is called with the errors of events and updates that couldn't be sent. It is also called with
+		// ErrTrackingQueueFull from the request's goroutine when a request is dropped, so it shouldn't block.
+		OnError func(uid string, err error)
+
+		once     sync.Once
+		mu       sync.RWMutex
+		closed   bool
+		queue    chan *trackedRequest
+		wg       sync.WaitGroup
+		lastSeen *lruCache
+		dropped  int64
+	}
+
+	trackedRequest struct {
+		uid      string
+		event    *AddUserEvent
+		lastSeen *time.Time
+	}
+
+	// statusRecorder captures the status code written by the wrapped handler
+	statusRecorder struct {
+		http.ResponseWriter
+		status int
+	}
+)
+
+// Handler wraps next so its requests are tracked
+func (m *TrackingMiddleware) Handler(next http.Handler) http.Handler {
+	m.once.Do(m.start)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		m.track(r, recorder.statusCode(), start)
+	})
+}
+
+// Dropped returns the number of requests that weren't tracked because the queue was full
+func (m *TrackingMiddleware) Dropped() int64 {
+	return atomic.LoadInt64(&m.dropped)
+}
+
+// Close stops accepting requests and waits until the queued ones are sent or ctx is done. Wrapped handlers keep
+// serving requests, which are no longer tracked.
+func (m *TrackingMiddleware) Close(ctx context.Context) error {
+	m.once.Do(m.start)
+
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *TrackingMiddleware) start() {
+	size := m.QueueSize
+	if size <= 0 {
+		size = defaultTrackingQueueSize
+	}
+	m.queue = make(chan *trackedRequest, size)
+
+	interval := m.LastSeenInterval
+	if interval <= 0 {
+		interval = defaultLastSeenInterval
+	}
+	m.lastSeen = newLruCache(CacheOptions{Size: lastSeenCacheSize, TTL: interval})
+
+	workers := m.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	m.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go m.work()
+	}
+}
+
+// track queues the request without ever blocking. Panics from the caller's funcs are recovered so they can't fail
+// a request that has already been served.
+func (m *TrackingMiddleware) track(r *http.Request, status int, start time.Time) {
+	var uid string
+	defer func() {
+		if p := recover(); p != nil {
+			m.reportError(uid, fmt.Errorf("goengage: tracking panicked: %v", p))
+		}
+	}()
+
+	if m.Users == nil || m.UserId == nil {
+		return
+	}
+	if uid = m.UserId(r); uid == "" {
+		return
+	}
+
+	req := &trackedRequest{uid: uid}
+	if m.sampled(r, status) {
+		route := r.URL.Path
+		if m.Route != nil {
+			route = m.Route(r)
+		}
+
+		name := m.Event
+		if name == "" {
+			name = defaultTrackingEvent
+		}
+
+		req.event = &AddUserEvent{
+			Event: name,
+			Properties: map[string]interface{}{
+				"route":   route,
+				"method":  r.Method,
+				"status":  status,
+				"latency": time.Since(start).Milliseconds(),
+			},
+			Timestamp: &start,
+		}
+	}
+
+	if m.LastSeenField != "" {
+		if m.lastSeen.reserve(uid) {
+			req.lastSeen = &start
+		}
+	}
+
+	if req.event == nil && req.lastSeen == nil {
+		return
+	}
+
+	if !m.enqueue(req) && req.lastSeen != nil {
+		m.lastSeen.invalidate(uid)
+	}
+}
+
+// enqueue hands req to the workers unless the middleware is closed or the queue is full
+func (m *TrackingMiddleware) enqueue(req *trackedRequest) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return false
+	}
+
+	select {
+	case m.queue <- req:
+		return true
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+		m.reportError(req.uid, ErrTrackingQueueFull)
+		return false
+	}
+}
+
+func (m *TrackingMiddleware) sampled(r *http.Request, status int) bool {
+	if m.Sample == nil {
+		return true
+	}
+
+	rate := m.Sample(r, status)
+	return rate >= 1 || (rate > 0 && rand.Float64() < rate)
+}
+
+func (m *TrackingMiddleware) work() {
+	defer m.wg.Done()
+
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = defaultTrackingTimeout
+	}
+
+	for req := range m.queue {
+		if req.event != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := addEventContext(ctx, m.Users, req.uid, req.event); err != nil {
+				m.reportError(req.uid, err)
+			}
+			cancel()
+		}
+
+		if req.lastSeen != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			_, err := updateAttributesContext(ctx, m.Users, req.uid, &UpdateUserAttributesInput{
+				Meta: map[string]interface{}{m.LastSeenField: req.lastSeen.UTC().Format(time.RFC3339)},
+			})
+			cancel()
+			if err != nil {
+				// The next request tries again
+				m.lastSeen.invalidate(req.uid)
+				m.reportError(req.uid, err)
+			}
+		}
+	}
+}
+
+func (m *TrackingMiddleware) reportError(uid string, err error) {
+	if m.OnError != nil {
+		m.OnError(uid, err)
+	}
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets handlers such as websocket upgrades take over the connection when the underlying writer allows it
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("goengage: %T can't be hijacked: %w", s.ResponseWriter, http.ErrNotSupported)
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && s.status == 0 {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Push forwards HTTP/2 server pushes to the underlying writer
+func (s *statusRecorder) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := s.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) statusCode() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
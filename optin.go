@@ -0,0 +1,162 @@
+package goengage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidConfirmationToken = errors.New("goengage: invalid confirmation token")
+	ErrExpiredConfirmationToken = errors.New("goengage: confirmation token has expired")
+)
+
+type (
+	// ConfirmationSigner generates and verifies signed tokens used to confirm double opt-in subscriptions.
+	// Tokens are HMAC-SHA256 signed, so anyone holding the secret can mint them. Keep it out of client side code.
+	ConfirmationSigner struct {
+		secret []byte
+		ttl    time.Duration
+		now    func() time.Time
+	}
+
+	ConfirmationClaims struct {
+		ListId    string    `json:"list_id"`
+		Uid       string    `json:"uid"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	// ConfirmationHandler confirms pending subscriptions from links carrying a token generated by Signer.
+	// The token is read from the "token" parameter. A GET request only shows a form that posts the token back, so
+	// link scanners and prefetchers following the link don't confirm anything; the subscription is confirmed on POST.
+	// Once confirmed, the subscriber is redirected to the list's RedirectUrl, or shown a plain confirmation message if
+	// the list has none.
+	ConfirmationHandler struct {
+		Lists  ListService
+		Signer *ConfirmationSigner
+	}
+)
+
+var confirmationForm = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Confirm your subscription</title></head>
+<body>
+<form method="post">
+<input type="hidden" name="token" value="{{.}}">
+<button type="submit">Confirm subscription</button>
+</form>
+</body>
+</html>
+`))
+
+// NewConfirmationSigner returns a signer whose tokens are valid for ttl
+func NewConfirmationSigner(secret []byte, ttl time.Duration) *ConfirmationSigner {
+	return &ConfirmationSigner{
+		secret: secret,
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+// Sign returns a url safe token confirming the subscription of uid to the list with listId
+func (s *ConfirmationSigner) Sign(listId, uid string) (string, error) {
+	if listId == "" {
+		return "", errors.New("goengage: list id is required")
+	}
+
+	if uid == "" {
+		return "", errors.New("goengage: uid is required")
+	}
+
+	payload, err := json.Marshal(&ConfirmationClaims{
+		ListId:    listId,
+		Uid:       uid,
+		ExpiresAt: s.now().Add(s.ttl).UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.sign(encoded)), nil
+}
+
+// Verify checks the token signature and expiry and returns the claims it carries
+func (s *ConfirmationSigner) Verify(token string) (*ConfirmationClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidConfirmationToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, s.sign(parts[0])) {
+		return nil, ErrInvalidConfirmationToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidConfirmationToken
+	}
+
+	var claims ConfirmationClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidConfirmationToken
+	}
+
+	if s.now().After(claims.ExpiresAt) {
+		return nil, ErrExpiredConfirmationToken
+	}
+
+	return &claims, nil
+}
+
+func (s *ConfirmationSigner) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func (h *ConfirmationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := h.Signer.Verify(r.FormValue("token"))
+	switch {
+	case errors.Is(err, ErrExpiredConfirmationToken):
+		http.Error(w, "This confirmation link has expired", http.StatusGone)
+		return
+	case err != nil:
+		http.Error(w, "This confirmation link is invalid", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		confirmationForm.Execute(w, r.FormValue("token"))
+		return
+	}
+
+	if err := h.Lists.ConfirmSubscription(claims.ListId, claims.Uid); err != nil {
+		http.Error(w, "Unable to confirm your subscription", http.StatusBadGateway)
+		return
+	}
+
+	list, err := h.Lists.GetList(claims.ListId)
+	if err != nil || list.RedirectUrl == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Your subscription has been confirmed"))
+		return
+	}
+
+	http.Redirect(w, r, list.RedirectUrl, http.StatusSeeOther)
+}
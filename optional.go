@@ -0,0 +1,75 @@
+package goengage
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Optional is a value that can be unset, explicitly null or set. The zero value is unset, so the field it belongs to
+// is left out of the request and the attribute is left untouched. Null clears the attribute.
+//
+//	input := &goengage.UpdateUserAttributesInput{
+//		FirstName: goengage.Set("Ada"),     // sets the first name
+//		Number:    goengage.Null[string](), // clears the number
+//	}
+type Optional[T any] struct {
+	value T
+	set   bool
+	null  bool
+}
+
+// Set returns an Optional holding value
+func Set[T any](value T) Optional[T] {
+	return Optional[T]{value: value, set: true}
+}
+
+// Null returns an Optional that clears the attribute it is sent for
+func Null[T any]() Optional[T] {
+	return Optional[T]{set: true, null: true}
+}
+
+// Get returns the value and whether one is held. It returns false for unset and null Optionals.
+func (o Optional[T]) Get() (T, bool) {
+	return o.value, o.set && !o.null
+}
+
+// IsSet reports whether the Optional is either null or holds a value
+func (o Optional[T]) IsSet() bool {
+	return o.set
+}
+
+// IsNull reports whether the Optional is explicitly null
+func (o Optional[T]) IsNull() bool {
+	return o.null
+}
+
+// MarshalJSON encodes null or the value. Unset Optionals are omitted by the inputs that hold them.
+func (o Optional[T]) MarshalJSON() ([]byte, error) {
+	if !o.set || o.null {
+		return []byte("null"), nil
+	}
+	return json.Marshal(o.value)
+}
+
+// UnmarshalJSON decodes null as Null and anything else as a value
+func (o *Optional[T]) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		*o = Null[T]()
+		return nil
+	}
+
+	var value T
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*o = Set(value)
+	return nil
+}
+
+// ptr returns nil for unset Optionals so fields can be left out with omitempty
+func (o Optional[T]) ptr() *Optional[T] {
+	if !o.set {
+		return nil
+	}
+	return &o
+}
@@ -0,0 +1,178 @@
+package goengage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Option configures a client created with NewClient
+type Option func(config *Config) error
+
+// NewClient creates a client from the given options. Without a credentials option, credentials are read from the
+// environment and then from ~/.engage/credentials. Values passed to options are never modified.
+//
+//	client, err := goengage.NewClient(
+//		goengage.WithCredentials(goengage.NewStaticCredentials("your_public_key", "your_private_key")),
+//		goengage.WithTimeout(5*time.Second),
+//	)
+func NewClient(opts ...Option) (*Client, error) {
+	config := NewConfig()
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if err := opt(config); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Credentials == nil && config.CredentialsProvider == nil {
+		config.CredentialsProvider = NewChainProvider(NewEnvProvider(), NewFileProvider("", ""))
+	}
+
+	return New(config)
+}
+
+// WithCredentials sets where the client gets its credentials from. Both *Credentials and providers such as
+// ChainProvider are accepted.
+func WithCredentials(provider CredentialsProvider) Option {
+	return func(config *Config) error {
+		if provider == nil || isNilProvider(provider) {
+			return errors.New("goengage: credentials provider is required")
+		}
+
+		if credentials, ok := provider.(*Credentials); ok {
+			config.Credentials = credentials
+			return nil
+		}
+		config.CredentialsProvider = provider
+		return nil
+	}
+}
+
+// WithHTTPClient sets the http client used to send requests
+func WithHTTPClient(client *http.Client) Option {
+	return func(config *Config) error {
+		if client == nil {
+			return errors.New("goengage: http client is required")
+		}
+		config.HTTPClient = client
+		return nil
+	}
+}
+
+// WithBaseUrl sets the API base url requests are sent to
+func WithBaseUrl(baseUrl string) Option {
+	return func(config *Config) error {
+		u, err := url.Parse(baseUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("goengage: base url %q is not an absolute http(s) url", baseUrl)
+		}
+		config.BaseUrl = baseUrl
+		return nil
+	}
+}
+
+// WithUserAgentSuffix appends suffix to the library's User-Agent, e.g. to identify the calling service
+func WithUserAgentSuffix(suffix string) Option {
+	return func(config *Config) error {
+		suffix = strings.TrimSpace(suffix)
+		if suffix == "" {
+			return nil
+		}
+
+		base := config.UserAgent
+		if base == "" {
+			base = userAgent
+		}
+		config.UserAgent = fmt.Sprintf("%v %v", base, suffix)
+		return nil
+	}
+}
+
+// WithTimeout sets the request timeout. When combined with WithHTTPClient, the client uses a copy of the provided
+// http client with this timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(config *Config) error {
+		if timeout <= 0 {
+			return errors.New("goengage: timeout must be positive")
+		}
+		config.Timeout = timeout
+		return nil
+	}
+}
+
+// WithRetry sets the policy used to retry failed requests
+func WithRetry(policy RetryPolicy) Option {
+	return func(config *Config) error {
+		if policy.MaxRetries < 0 || policy.MinBackoff < 0 || policy.MaxBackoff < 0 {
+			return errors.New("goengage: retry policy values must not be negative")
+		}
+		config.Retry = policy
+		return nil
+	}
+}
+
+// WithLogger sets the logger receiving diagnostic messages such as retries
+func WithLogger(logger Logger) Option {
+	return func(config *Config) error {
+		config.Logger = logger
+		return nil
+	}
+}
+
+// WithCache enables caching of Users.Get and Lists.GetList
+func WithCache(options CacheOptions) Option {
+	return func(config *Config) error {
+		config.Cache = &options
+		return nil
+	}
+}
+
+// WithMaxResponseSize sets the largest response body, in bytes, the client accepts
+func WithMaxResponseSize(size int64) Option {
+	return func(config *Config) error {
+		if size <= 0 {
+			return errors.New("goengage: max response size must be positive")
+		}
+		config.MaxResponseSize = size
+		return nil
+	}
+}
+
+// WithGzipRequests gzips request bodies of at least threshold bytes
+func WithGzipRequests(threshold int) Option {
+	return func(config *Config) error {
+		if threshold <= 0 {
+			return errors.New("goengage: gzip threshold must be positive")
+		}
+		config.GzipRequestThreshold = threshold
+		return nil
+	}
+}
+
+// WithEventRegistry validates events against registry before they are sent
+func WithEventRegistry(registry *EventRegistry) Option {
+	return func(config *Config) error {
+		if registry == nil {
+			return errors.New("goengage: event registry is required")
+		}
+		config.Events = registry
+		return nil
+	}
+}
+
+// WithDedup skips events whose idempotency key is already in store
+func WithDedup(store DedupStore) Option {
+	return func(config *Config) error {
+		if store == nil {
+			return errors.New("goengage: dedup store is required")
+		}
+		config.Dedup = store
+		return nil
+	}
+}
@@ -0,0 +1,625 @@
+package goengage
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OutboxSQLite OutboxDialect = iota
+	OutboxPostgres
+	OutboxMySQL
+)
+
+const (
+	OutboxCreate           OutboxOperation = "create"
+	OutboxUpdateAttributes OutboxOperation = "update_attributes"
+	OutboxAddEvent         OutboxOperation = "add_event"
+	OutboxSubscribeList    OutboxOperation = "subscribe_list"
+)
+
+const (
+	defaultOutboxTable        = "engage_outbox"
+	defaultOutboxBatchSize    = 10
+	defaultOutboxLease        = time.Minute
+	defaultOutboxPollInterval = time.Second
+	defaultOutboxMaxAttempts  = 10
+	maxOutboxBackoff          = time.Hour
+)
+
+var (
+	outboxTablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// errInvalidOutboxMessage is wrapped by the errors of messages that can never be delivered
+	errInvalidOutboxMessage = errors.New("goengage: invalid outbox message")
+)
+
+type (
+	// OutboxDialect is the database holding the outbox, which decides the SQL used
+	OutboxDialect   int
+	OutboxOperation string
+
+	// OutboxExecer runs the inserts of an Outbox. It is implemented by *sql.Tx, as well as *sql.DB and *sql.Conn.
+	OutboxExecer interface {
+		ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	}
+
+	// Outbox records engage.so operations in a table of your own database, so they can be written in the same
+	// transaction as the changes they reflect and are only sent once that transaction commits. OutboxRelay delivers
+	// them. Call Migrate to create or upgrade the table before using it.
+	Outbox struct {
+		DB      *sql.DB
+		Dialect OutboxDialect
+		// Table defaults to "engage_outbox". Migrations are tracked in the table of the same name suffixed with
+		// "_migrations".
+		Table string
+	}
+
+	// OutboxMessage is an operation recorded in the outbox
+	OutboxMessage struct {
+		Id        int64
+		Operation OutboxOperation
+		// Target is the uid of the user, or the id of the list for OutboxSubscribeList
+		Target  string
+		Payload json.RawMessage
+		// Attempts is the number of deliveries attempted before this one
+		Attempts  int
+		CreatedAt time.Time
+	}
+
+	// OutboxRelay delivers the operations of an Outbox. Several relays, in the same process or not, can share an
+	// outbox: each message is leased to a single relay at a time, and is delivered again by another relay if its
+	// lease expires before it's done. A relay stops delivering its batch when its lease is about to expire, and
+	// deliveries are cancelled once it has. Delivery is still at least once, so events are sent with an idempotency
+	// key, made up of the table and message id unless they have their own.
+	//
+	// Messages with the same target are delivered in order, across relays: a message waits until the ones recorded
+	// before it were delivered or failed, so updates and events of a user are never sent before its creation.
+	// The order is the order of the message ids. On SQLite, where writes are serialized, that is the commit order.
+	// PostgreSQL and MySQL assign ids when rows are inserted, so messages of the same target written by concurrent
+	// transactions can be delivered in a different order than their transactions committed, and a message committed
+	// late may be delivered after later ones were. Write the messages of a target from transactions that don't
+	// overlap, e.g. by locking the user's row, when their order matters.
+	//
+	// Failed deliveries are retried with an exponential backoff. Messages the API rejects, and messages still failing
+	// after MaxAttempts, are marked as failed and left in the table; see Outbox.RetryFailed. A user that isn't found
+	// isn't a rejection for messages recorded after a Create of the user that didn't fail.
+	OutboxRelay struct {
+		Outbox *Outbox
+		Users  UserService
+		Lists  ListService
+		// BatchSize is the number of messages leased at once. Defaults to 10.
+		BatchSize int
+		// Lease is how long a relay has to deliver the messages it leased. Defaults to 1 minute.
+		Lease time.Duration
+		// PollInterval is how long Run waits when there's nothing to deliver. Defaults to 1 second.
+		PollInterval time.Duration
+		// MaxAttempts defaults to 10
+		MaxAttempts int
+		// Backoff returns the delay before the next delivery of a message that failed attempts times. Defaults to
+		// 1 second doubled on every attempt, up to 1 hour.
+		Backoff func(attempts int) time.Duration
+		// OnError is called with the errors of messages that couldn't be delivered, and with a nil message for the
+		// database errors Run recovers from.
+		OnError func(message *OutboxMessage, err error)
+	}
+)
+
+// Migrate creates the outbox table or brings it up to date. Run it when deploying or starting up; concurrent
+// migrations of the same table may fail.
+func (o *Outbox) Migrate(ctx context.Context) error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	table := o.table() + "_migrations"
+	if _, err := o.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+table+" (version INTEGER PRIMARY KEY)"); err != nil {
+		return fmt.Errorf("goengage: unable to create %v: %w", table, err)
+	}
+
+	var version int
+	if err := o.DB.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM "+table).Scan(&version); err != nil {
+		return fmt.Errorf("goengage: unable to read outbox version: %w", err)
+	}
+
+	migrations := o.migrations()
+	for ; version < len(migrations); version++ {
+		tx, err := o.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("goengage: %w", err)
+		}
+
+		if _, err := tx.ExecContext(ctx, migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("goengage: outbox migration %v failed: %w", version+1, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, o.rebind("INSERT INTO "+table+" (version) VALUES (?)"), version+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("goengage: outbox migration %v failed: %w", version+1, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("goengage: outbox migration %v failed: %w", version+1, err)
+		}
+	}
+	return nil
+}
+
+// migrations returns the statements creating the table, one per version
+func (o *Outbox) migrations() []string {
+	id, text := "INTEGER PRIMARY KEY AUTOINCREMENT", "TEXT"
+	switch o.Dialect {
+	case OutboxPostgres:
+		id = "BIGSERIAL PRIMARY KEY"
+	case OutboxMySQL:
+		id, text = "BIGINT AUTO_INCREMENT PRIMARY KEY", "MEDIUMTEXT"
+	}
+
+	// Times are Unix nanoseconds, which every database and driver handles the same way
+	table := o.table()
+	return []string{
+		`CREATE TABLE ` + table + ` (
+			id ` + id + `,
+			operation VARCHAR(32) NOT NULL,
+			target VARCHAR(255) NOT NULL,
+			payload ` + text + ` NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error ` + text + `,
+			created_at BIGINT NOT NULL,
+			available_at BIGINT NOT NULL,
+			lock_token VARCHAR(64),
+			locked_until BIGINT NOT NULL DEFAULT 0,
+			delivered_at BIGINT,
+			failed_at BIGINT
+		)`,
+		`CREATE INDEX ` + table + `_pending ON ` + table + ` (delivered_at, failed_at, available_at)`,
+		`CREATE INDEX ` + table + `_target ON ` + table + ` (target, id)`,
+	}
+}
+
+// Create records the creation of a user
+func (o *Outbox) Create(ctx context.Context, tx OutboxExecer, input *CreateUserInput) error {
+	if input == nil {
+		return errors.New("goengage: input is required")
+	}
+	return o.enqueue(ctx, tx, OutboxCreate, input.Id, input)
+}
+
+// UpdateAttributes records an update of the attributes of the user. Conditional updates aren't supported, so an
+// input with IfMatch set is rejected.
+func (o *Outbox) UpdateAttributes(ctx context.Context, tx OutboxExecer, uid string, input *UpdateUserAttributesInput) error {
+	if uid == "" || input == nil {
+		return errors.New("goengage: uid and input are required")
+	}
+	if input.IfMatch != "" {
+		return errors.New("goengage: IfMatch can't be used with the outbox, the user may have changed by the time it is delivered")
+	}
+	return o.enqueue(ctx, tx, OutboxUpdateAttributes, uid, input)
+}
+
+// AddEvent records an event of the user
+func (o *Outbox) AddEvent(ctx context.Context, tx OutboxExecer, uid string, event *AddUserEvent) error {
+	if uid == "" || event == nil {
+		return errors.New("goengage: uid and event are required")
+	}
+	return o.enqueue(ctx, tx, OutboxAddEvent, uid, &outboxEvent{AddUserEvent: *event, IdempotencyKey: event.IdempotencyKey})
+}
+
+// SubscribeList records the subscription of a user to the list
+func (o *Outbox) SubscribeList(ctx context.Context, tx OutboxExecer, id string, input *SubscribeListInput) error {
+	if id == "" || input == nil {
+		return errors.New("goengage: id and input are required")
+	}
+	return o.enqueue(ctx, tx, OutboxSubscribeList, id, input)
+}
+
+// outboxEvent keeps the idempotency key, which isn't part of the JSON of AddUserEvent
+type outboxEvent struct {
+	AddUserEvent
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+func (o *Outbox) enqueue(ctx context.Context, tx OutboxExecer, operation OutboxOperation, target string, payload interface{}) error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	query := o.rebind("INSERT INTO " + o.table() + " (operation, target, payload, created_at, available_at) VALUES (?, ?, ?, ?, ?)")
+	if _, err := tx.ExecContext(ctx, query, string(operation), target, string(content), now, now); err != nil {
+		return fmt.Errorf("goengage: unable to record %v: %w", operation, err)
+	}
+	return nil
+}
+
+// Prune deletes the messages delivered before the given time and returns how many were deleted
+func (o *Outbox) Prune(ctx context.Context, before time.Time) (int64, error) {
+	if err := o.validate(); err != nil {
+		return 0, err
+	}
+
+	query := o.rebind("DELETE FROM " + o.table() + " WHERE delivered_at IS NOT NULL AND delivered_at < ?")
+	result, err := o.DB.ExecContext(ctx, query, before.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("goengage: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// RetryFailed schedules the failed messages for delivery again, with their attempts reset, and returns how many
+// were rescheduled
+func (o *Outbox) RetryFailed(ctx context.Context) (int64, error) {
+	if err := o.validate(); err != nil {
+		return 0, err
+	}
+
+	query := o.rebind("UPDATE " + o.table() + " SET failed_at = NULL, attempts = 0, available_at = ? WHERE failed_at IS NOT NULL")
+	result, err := o.DB.ExecContext(ctx, query, time.Now().UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("goengage: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (o *Outbox) validate() error {
+	if o.DB == nil {
+		return errors.New("goengage: outbox database is required")
+	}
+	if !outboxTablePattern.MatchString(o.table()) {
+		return fmt.Errorf("goengage: invalid outbox table %q", o.table())
+	}
+	return nil
+}
+
+func (o *Outbox) table() string {
+	if o.Table == "" {
+		return defaultOutboxTable
+	}
+	return o.Table
+}
+
+// rebind replaces the ? placeholders of query with the ones of the dialect
+func (o *Outbox) rebind(query string) string {
+	if o.Dialect != OutboxPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// Run delivers messages until ctx is done, and then returns its error
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	for {
+		n, err := r.Process(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			r.reportError(nil, err)
+		}
+
+		if err == nil && n == r.batchSize() {
+			continue
+		}
+
+		interval := r.PollInterval
+		if interval <= 0 {
+			interval = defaultOutboxPollInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Process leases a batch of messages and delivers them. It returns the number of messages leased, whether or not
+// their delivery succeeded, and an error only when the database couldn't be used.
+func (r *OutboxRelay) Process(ctx context.Context) (int, error) {
+	if r.Outbox == nil || r.Users == nil || r.Lists == nil {
+		return 0, errors.New("goengage: outbox relay needs an outbox, users and lists")
+	}
+	if err := r.Outbox.validate(); err != nil {
+		return 0, err
+	}
+
+	token, leasedUntil, messages, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, message := range messages {
+		// Once the lease expires another relay may deliver the same messages, so the rest of the batch is handed
+		// back when there's too little time left to deliver the next one
+		if ctx.Err() != nil || time.Until(leasedUntil) < r.lease()/10 {
+			return len(messages), r.release(token, messages[i:])
+		}
+
+		deliverCtx, cancel := context.WithDeadline(ctx, leasedUntil)
+		deliveryErr := r.deliver(deliverCtx, message)
+		cancel()
+		if deliveryErr != nil {
+			r.reportError(message, deliveryErr)
+		}
+
+		// Bookkeeping outlives ctx, so a cancelled run doesn't leave delivered messages to be sent again
+		finishCtx, cancel := context.WithTimeout(context.Background(), r.lease())
+		err := r.finish(finishCtx, token, message, deliveryErr)
+		cancel()
+		if err != nil {
+			return len(messages), err
+		}
+	}
+	return len(messages), nil
+}
+
+// claim leases up to BatchSize messages available for delivery, and returns the lease's token and expiry. Messages
+// are leased one at a time with a conditional update, so relays racing for a message can't both get it. Only the
+// oldest pending message of each target is available.
+func (r *OutboxRelay) claim(ctx context.Context) (string, time.Time, []*OutboxMessage, error) {
+	o := r.Outbox
+	table := o.table()
+	now := time.Now()
+	leasedUntil := now.Add(r.lease())
+
+	rows, err := o.DB.QueryContext(ctx, o.rebind(fmt.Sprintf("SELECT id FROM %[1]v m WHERE delivered_at IS NULL AND "+
+		"failed_at IS NULL AND available_at <= ? AND locked_until <= ? AND NOT EXISTS (SELECT 1 FROM %[1]v p WHERE "+
+		"p.target = m.target AND p.id < m.id AND p.delivered_at IS NULL AND p.failed_at IS NULL) ORDER BY id LIMIT %[2]d",
+		table, r.batchSize())), now.UnixNano(), now.UnixNano())
+	if err != nil {
+		return "", now, nil, fmt.Errorf("goengage: unable to read outbox: %w", err)
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return "", now, nil, fmt.Errorf("goengage: unable to read outbox: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", now, nil, fmt.Errorf("goengage: unable to read outbox: %w", err)
+	}
+	if len(ids) == 0 {
+		return "", now, nil, nil
+	}
+
+	token, err := newLeaseToken()
+	if err != nil {
+		return "", now, nil, err
+	}
+
+	lease := o.rebind("UPDATE " + table + " SET lock_token = ?, locked_until = ? WHERE id = ? AND " +
+		"delivered_at IS NULL AND failed_at IS NULL AND locked_until <= ?")
+	claimed := 0
+	for _, id := range ids {
+		result, err := o.DB.ExecContext(ctx, lease, token, leasedUntil.UnixNano(), id, now.UnixNano())
+		if err != nil {
+			return "", now, nil, fmt.Errorf("goengage: unable to lease outbox message %v: %w", id, err)
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			claimed++
+		}
+	}
+	if claimed == 0 {
+		return "", now, nil, nil
+	}
+
+	rows, err = o.DB.QueryContext(ctx, o.rebind("SELECT id, operation, target, payload, attempts, created_at FROM "+
+		table+" WHERE lock_token = ? ORDER BY id"), token)
+	if err != nil {
+		return "", now, nil, fmt.Errorf("goengage: unable to read outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*OutboxMessage
+	for rows.Next() {
+		var (
+			message   OutboxMessage
+			payload   string
+			createdAt int64
+		)
+		if err := rows.Scan(&message.Id, &message.Operation, &message.Target, &payload, &message.Attempts, &createdAt); err != nil {
+			return "", now, nil, fmt.Errorf("goengage: unable to read outbox: %w", err)
+		}
+		message.Payload = json.RawMessage(payload)
+		message.CreatedAt = time.Unix(0, createdAt)
+		messages = append(messages, &message)
+	}
+	if err := rows.Err(); err != nil {
+		return "", now, nil, fmt.Errorf("goengage: unable to read outbox: %w", err)
+	}
+	return token, leasedUntil, messages, nil
+}
+
+func (r *OutboxRelay) deliver(ctx context.Context, message *OutboxMessage) error {
+	decode := func(v interface{}) error {
+		if err := json.Unmarshal(message.Payload, v); err != nil {
+			return fmt.Errorf("%w %v: %v", errInvalidOutboxMessage, message.Id, err)
+		}
+		return nil
+	}
+
+	switch message.Operation {
+	case OutboxCreate:
+		var input CreateUserInput
+		if err := decode(&input); err != nil {
+			return err
+		}
+		_, err := createContext(ctx, r.Users, &input)
+		return err
+
+	case OutboxUpdateAttributes:
+		var input UpdateUserAttributesInput
+		if err := decode(&input); err != nil {
+			return err
+		}
+		_, err := updateAttributesContext(ctx, r.Users, message.Target, &input)
+		return err
+
+	case OutboxAddEvent:
+		var event outboxEvent
+		if err := decode(&event); err != nil {
+			return err
+		}
+
+		event.AddUserEvent.IdempotencyKey = event.IdempotencyKey
+		if event.IdempotencyKey == "" {
+			event.AddUserEvent.IdempotencyKey = r.Outbox.table() + ":" + strconv.FormatInt(message.Id, 10)
+		}
+		return addEventContext(ctx, r.Users, message.Target, &event.AddUserEvent)
+
+	case OutboxSubscribeList:
+		var input SubscribeListInput
+		if err := decode(&input); err != nil {
+			return err
+		}
+		_, err := subscribeListContext(ctx, r.Lists, message.Target, &input)
+		return err
+	}
+
+	return fmt.Errorf("%w %v: unsupported operation %q", errInvalidOutboxMessage, message.Id, message.Operation)
+}
+
+// finish records the outcome of a delivery, unless the lease was lost to another relay in the meantime
+func (r *OutboxRelay) finish(ctx context.Context, token string, message *OutboxMessage, deliveryErr error) error {
+	o := r.Outbox
+	now := time.Now()
+	attempts := message.Attempts + 1
+	rejected := isEventRejected(deliveryErr) && !r.followsCreate(ctx, message, deliveryErr)
+
+	var (
+		query string
+		args  []interface{}
+	)
+	switch {
+	case deliveryErr == nil:
+		query = "UPDATE " + o.table() + " SET delivered_at = ?, attempts = ?, last_error = NULL, lock_token = NULL, " +
+			"locked_until = 0 WHERE id = ? AND lock_token = ?"
+		args = []interface{}{now.UnixNano(), attempts, message.Id, token}
+
+	case rejected || errors.Is(deliveryErr, errInvalidOutboxMessage) || attempts >= r.maxAttempts():
+		query = "UPDATE " + o.table() + " SET failed_at = ?, attempts = ?, last_error = ?, lock_token = NULL, " +
+			"locked_until = 0 WHERE id = ? AND lock_token = ?"
+		args = []interface{}{now.UnixNano(), attempts, deliveryErr.Error(), message.Id, token}
+
+	default:
+		query = "UPDATE " + o.table() + " SET available_at = ?, attempts = ?, last_error = ?, lock_token = NULL, " +
+			"locked_until = 0 WHERE id = ? AND lock_token = ?"
+		args = []interface{}{now.Add(r.backoff(attempts)).UnixNano(), attempts, deliveryErr.Error(), message.Id, token}
+	}
+
+	if _, err := o.DB.ExecContext(ctx, o.rebind(query), args...); err != nil {
+		return fmt.Errorf("goengage: unable to update outbox message %v: %w", message.Id, err)
+	}
+	return nil
+}
+
+// followsCreate reports whether message failed because its user wasn't found, although it was recorded after a
+// Create of the user that didn't fail, so the user should exist once the Create is visible to the API. Database
+// errors count as such a Create, so the message is retried.
+func (r *OutboxRelay) followsCreate(ctx context.Context, message *OutboxMessage, deliveryErr error) bool {
+	var apiErr Error
+	if message.Operation == OutboxCreate || message.Operation == OutboxSubscribeList ||
+		!errors.As(deliveryErr, &apiErr) || apiErr.Code != http.StatusNotFound {
+		return false
+	}
+
+	var creates int
+	err := r.Outbox.DB.QueryRowContext(ctx, r.Outbox.rebind("SELECT COUNT(*) FROM "+r.Outbox.table()+" WHERE target = ? "+
+		"AND operation = ? AND id < ? AND failed_at IS NULL"), message.Target, string(OutboxCreate), message.Id).Scan(&creates)
+	return err != nil || creates > 0
+}
+
+// release hands the messages of the lease that weren't delivered back to other relays
+func (r *OutboxRelay) release(token string, messages []*OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.lease())
+	defer cancel()
+
+	query := r.Outbox.rebind("UPDATE " + r.Outbox.table() + " SET lock_token = NULL, locked_until = 0 WHERE lock_token = ?")
+	if _, err := r.Outbox.DB.ExecContext(ctx, query, token); err != nil {
+		return fmt.Errorf("goengage: unable to release %v outbox messages: %w", len(messages), err)
+	}
+	return nil
+}
+
+func (r *OutboxRelay) backoff(attempts int) time.Duration {
+	if r.Backoff != nil {
+		return r.Backoff(attempts)
+	}
+
+	if attempts > 12 {
+		return maxOutboxBackoff
+	}
+	if delay := time.Second << (attempts - 1); delay < maxOutboxBackoff {
+		return delay
+	}
+	return maxOutboxBackoff
+}
+
+func (r *OutboxRelay) reportError(message *OutboxMessage, err error) {
+	if r.OnError != nil {
+		r.OnError(message, err)
+	}
+}
+
+func (r *OutboxRelay) batchSize() int {
+	if r.BatchSize <= 0 {
+		return defaultOutboxBatchSize
+	}
+	return r.BatchSize
+}
+
+func (r *OutboxRelay) lease() time.Duration {
+	if r.Lease <= 0 {
+		return defaultOutboxLease
+	}
+	return r.Lease
+}
+
+func (r *OutboxRelay) maxAttempts() int {
+	if r.MaxAttempts <= 0 {
+		return defaultOutboxMaxAttempts
+	}
+	return r.MaxAttempts
+}
+
+// newLeaseToken returns a random token identifying a lease
+func newLeaseToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("goengage: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,5 @@
+// Package outboxtest runs the goengage.Outbox tests against SQLite. It is a module of its own so the SQLite driver
+// stays out of the requirements of goengage itself:
+//
+//	cd outboxtest && go test ./...
+package outboxtest
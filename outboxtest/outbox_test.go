@@ -0,0 +1,363 @@
+package outboxtest
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/heroshe/goengage"
+	"github.com/stretchr/testify/assert"
+	_ "modernc.org/sqlite"
+)
+
+// blockingUsers stands in for a relay that stalls: AddEvent ignores its context and waits until release is closed
+type blockingUsers struct {
+	goengage.UserService
+	started chan struct{}
+	release chan struct{}
+}
+
+func (u *blockingUsers) AddEvent(uid string, event *goengage.AddUserEvent) error {
+	close(u.started)
+	<-u.release
+	return nil
+}
+
+func newTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SQLite allows a single writer
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newTestClient(t *testing.T, baseUrl string) *goengage.Client {
+	c, err := goengage.New(goengage.NewConfig().WithCredentials(goengage.NewStaticCredentials("my_public_key", "my_private_key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.BaseUrl = baseUrl
+	return c
+}
+
+// processAll delivers messages until none is available
+func processAll(t *testing.T, relay *goengage.OutboxRelay) {
+	for i := 0; i < 100; i++ {
+		n, err := relay.Process(context.Background())
+		assert.Nil(t, err)
+		if n == 0 {
+			return
+		}
+	}
+	t.Fatal("outbox never drained")
+}
+
+func count(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	var n int
+	assert.Nil(t, db.QueryRow(query, args...).Scan(&n))
+	return n
+}
+
+func TestOutbox(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		bodies   []map[string]interface{}
+		keys     []string
+		flaky    int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		bodies = append(bodies, body)
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+
+		switch r.URL.Path {
+		case "/users/rejected/events":
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		case "/users/flaky":
+			if flaky++; flaky == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	db := newTestDB(t)
+	outbox := &goengage.Outbox{DB: db}
+	assert.Nil(t, outbox.Migrate(ctx))
+	assert.Nil(t, outbox.Migrate(ctx))
+
+	// Operations of transactions that are rolled back are never sent
+	tx, err := db.BeginTx(ctx, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, outbox.AddEvent(ctx, tx, "u1", &goengage.AddUserEvent{Event: "rolled_back"}))
+	assert.Nil(t, tx.Rollback())
+
+	tx, err = db.BeginTx(ctx, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, outbox.Create(ctx, tx, &goengage.CreateUserInput{Id: "u1", Email: goengage.String("ada@heroshe.com")}))
+	assert.Nil(t, outbox.UpdateAttributes(ctx, tx, "u1", &goengage.UpdateUserAttributesInput{
+		FirstName: goengage.Set("Ada"), DeleteMeta: []string{"plan"}}))
+	assert.Nil(t, outbox.AddEvent(ctx, tx, "u1", &goengage.AddUserEvent{Event: "signup", IdempotencyKey: "signup_u1"}))
+	assert.Nil(t, outbox.AddEvent(ctx, tx, "u1", &goengage.AddUserEvent{Event: "login"}))
+	assert.Nil(t, outbox.SubscribeList(ctx, tx, "list1", &goengage.SubscribeListInput{Email: goengage.String("ada@heroshe.com")}))
+	assert.Nil(t, outbox.AddEvent(ctx, tx, "rejected", &goengage.AddUserEvent{Event: "login"}))
+	assert.Nil(t, outbox.UpdateAttributes(ctx, tx, "flaky", &goengage.UpdateUserAttributesInput{Email: goengage.Set("ada@heroshe.com")}))
+	assert.NotNil(t, outbox.UpdateAttributes(ctx, tx, "u1", &goengage.UpdateUserAttributesInput{
+		FirstName: goengage.Set("Ada"), IfMatch: `"v1"`}))
+	assert.Nil(t, tx.Commit())
+
+	c := newTestClient(t, server.URL)
+	relay := &goengage.OutboxRelay{Outbox: outbox, Users: c.Users, Lists: c.Lists,
+		Backoff: func(int) time.Duration { return 0 }}
+
+	// A batch holds a single message per target
+	n, err := relay.Process(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.ElementsMatch(t, []string{"POST /users", "POST /lists/list1/subscribers", "PUT /users/rejected/events",
+		"PUT /users/flaky"}, requests)
+
+	processAll(t, relay)
+	var u1 []string
+	for i, request := range requests {
+		if strings.Contains(request, "/u1") || bodies[i]["id"] == "u1" {
+			u1 = append(u1, request)
+		}
+	}
+	assert.Equal(t, []string{"POST /users", "PUT /users/u1", "PUT /users/u1/events", "PUT /users/u1/events"}, u1)
+	assert.Contains(t, bodies, map[string]interface{}{"id": "u1", "email": "ada@heroshe.com"})
+	assert.Contains(t, bodies, map[string]interface{}{"first_name": "Ada", "meta": map[string]interface{}{"plan": nil}})
+	assert.Contains(t, keys, "signup_u1")
+	assert.Equal(t, 2, strings.Count(strings.Join(requests, ","), "PUT /users/flaky"))
+
+	var generated int
+	for _, key := range keys {
+		if strings.HasPrefix(key, "engage_outbox:") {
+			generated++
+		}
+	}
+	assert.Equal(t, 2, generated)
+
+	assert.Equal(t, 6, count(t, db, "SELECT COUNT(*) FROM engage_outbox WHERE delivered_at IS NOT NULL"))
+	assert.Equal(t, 1, count(t, db, "SELECT COUNT(*) FROM engage_outbox WHERE failed_at IS NOT NULL"))
+
+	retried, err := outbox.RetryFailed(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), retried)
+
+	pruned, err := outbox.Prune(ctx, time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), pruned)
+
+	assert.NotNil(t, (&goengage.Outbox{DB: db, Table: "engage_outbox; DROP TABLE users"}).Migrate(ctx))
+}
+
+func TestOutboxRelay_Ordering(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		created  = map[string]bool{}
+		fails    = map[string]int{"POST /users": 1, "PUT /users/u2": 1}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		request := r.Method + " " + r.URL.Path
+		requests = append(requests, request)
+
+		// The first creation fails, and u2 isn't visible yet the first time it's updated
+		if fails[request] > 0 {
+			fails[request]--
+			if request == "POST /users" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			return
+		}
+
+		if uid, ok := body["id"].(string); ok {
+			created[uid] = true
+		}
+		if uid := strings.TrimPrefix(r.URL.Path, "/users/"); r.Method == http.MethodPut && !created[uid] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	db := newTestDB(t)
+	outbox := &goengage.Outbox{DB: db}
+	assert.Nil(t, outbox.Migrate(ctx))
+	assert.Nil(t, outbox.Create(ctx, db, &goengage.CreateUserInput{Id: "u1"}))
+	assert.Nil(t, outbox.UpdateAttributes(ctx, db, "u1", &goengage.UpdateUserAttributesInput{FirstName: goengage.Set("Ada")}))
+	assert.Nil(t, outbox.Create(ctx, db, &goengage.CreateUserInput{Id: "u2"}))
+	assert.Nil(t, outbox.UpdateAttributes(ctx, db, "u2", &goengage.UpdateUserAttributesInput{FirstName: goengage.Set("Grace")}))
+	assert.Nil(t, outbox.UpdateAttributes(ctx, db, "u3", &goengage.UpdateUserAttributesInput{FirstName: goengage.Set("Alan")}))
+
+	c := newTestClient(t, server.URL)
+	relay := &goengage.OutboxRelay{Outbox: outbox, Users: c.Users, Lists: c.Lists,
+		Backoff: func(int) time.Duration { return 0 }}
+	processAll(t, relay)
+
+	// The update of u1 waits for its creation to go through, and u2 not being visible right after its creation is
+	// retried, while u3 was never created by the outbox
+	var u1, u2 []string
+	for _, request := range requests {
+		switch {
+		case strings.HasSuffix(request, "/u1"):
+			u1 = append(u1, request)
+		case strings.HasSuffix(request, "/u2"):
+			u2 = append(u2, request)
+		}
+	}
+	assert.Equal(t, []string{"PUT /users/u1"}, u1)
+	assert.Equal(t, []string{"PUT /users/u2", "PUT /users/u2"}, u2)
+	assert.Equal(t, 4, count(t, db, "SELECT COUNT(*) FROM engage_outbox WHERE delivered_at IS NOT NULL"))
+	assert.Equal(t, 1, count(t, db, "SELECT COUNT(*) FROM engage_outbox WHERE failed_at IS NOT NULL AND target = 'u3'"))
+}
+
+func TestOutboxRelay_Lease(t *testing.T) {
+	var delivered int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&delivered, 1)
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	db := newTestDB(t)
+	outbox := &goengage.Outbox{DB: db, Table: "outbox"}
+	assert.Nil(t, outbox.Migrate(ctx))
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, outbox.AddEvent(ctx, db, fmt.Sprintf("u%v", i), &goengage.AddUserEvent{Event: "login"}))
+	}
+
+	c := newTestClient(t, server.URL)
+	lease := 300 * time.Millisecond
+	newRelay := func(users goengage.UserService) *goengage.OutboxRelay {
+		return &goengage.OutboxRelay{Outbox: outbox, Users: users, Lists: c.Lists, BatchSize: 3, Lease: lease}
+	}
+
+	// A relay that stalls on its first message keeps its batch until its lease expires
+	stalled := &blockingUsers{started: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		_, err := newRelay(stalled).Process(ctx)
+		done <- err
+	}()
+	<-stalled.started
+
+	// Concurrent relays deliver the other messages exactly once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			relay := newRelay(c.Users)
+			for {
+				n, err := relay.Process(ctx)
+				if err != nil || n == 0 {
+					assert.Nil(t, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(17), atomic.LoadInt64(&delivered))
+
+	time.Sleep(lease)
+	processAll(t, newRelay(c.Users))
+	assert.Equal(t, int64(20), atomic.LoadInt64(&delivered))
+
+	// The stalled relay lost its lease, so the outcome of its delivery isn't recorded and the rest of its batch was
+	// left to the others
+	close(stalled.release)
+	assert.Nil(t, <-done)
+	assert.Equal(t, 0, count(t, db, "SELECT COUNT(*) FROM outbox WHERE delivered_at IS NULL"))
+	assert.Equal(t, 20, count(t, db, "SELECT COUNT(*) FROM outbox WHERE attempts = 1"))
+}
+
+func TestOutboxRelay_SlowDelivery(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		inFlight int
+		overlap  bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if inFlight++; inFlight > 1 {
+			overlap = true
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+
+		select {
+		case <-time.After(150 * time.Millisecond):
+			_, _ = w.Write([]byte(`{"status":"ok"}`))
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	db := newTestDB(t)
+	outbox := &goengage.Outbox{DB: db}
+	assert.Nil(t, outbox.Migrate(ctx))
+	for _, uid := range []string{"u1", "u2", "u3"} {
+		assert.Nil(t, outbox.Create(ctx, db, &goengage.CreateUserInput{Id: uid}))
+	}
+
+	c := newTestClient(t, server.URL)
+	relay := &goengage.OutboxRelay{Outbox: outbox, Users: c.Users, Lists: c.Lists, Lease: 200 * time.Millisecond}
+
+	// The first creation is delivered, the second is cancelled when the lease expires and the third is handed back
+	// without being sent
+	start := time.Now()
+	n, err := relay.Process(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Less(t, time.Since(start), 300*time.Millisecond)
+
+	assert.Equal(t, 1, count(t, db, "SELECT COUNT(*) FROM engage_outbox WHERE target = 'u1' AND delivered_at IS NOT NULL"))
+	assert.Equal(t, 1, count(t, db, "SELECT COUNT(*) FROM engage_outbox WHERE target = 'u2' AND attempts = 1 AND "+
+		"delivered_at IS NULL AND last_error LIKE '%deadline exceeded%'"))
+	assert.Equal(t, 1, count(t, db, "SELECT COUNT(*) FROM engage_outbox WHERE target = 'u3' AND attempts = 0 AND "+
+		"lock_token IS NULL AND locked_until = 0"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.False(t, overlap)
+}
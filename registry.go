@@ -0,0 +1,141 @@
+package goengage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errNotInWorkspace marks workspaces skipped by fan-out helpers because the user doesn't exist there
+var errNotInWorkspace = errors.New("goengage: user is not in workspace")
+
+type (
+	// Registry holds one client per engage.so workspace, e.g. one per region or brand, and routes calls by
+	// workspace key. Every client in the registry shares the registry's http client and so its connection pool.
+	Registry struct {
+		httpClient *http.Client
+		mu         sync.RWMutex
+		clients    map[string]*Client
+	}
+
+	WorkspaceResult struct {
+		Workspace string
+		Err       error
+	}
+)
+
+// NewRegistry returns an empty registry whose clients share httpClient. A nil httpClient uses the same defaults as New.
+func NewRegistry(httpClient *http.Client) *Registry {
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Timeout: 10 * time.Second,
+		}
+	}
+
+	return &Registry{
+		httpClient: httpClient,
+		clients:    map[string]*Client{},
+	}
+}
+
+// Register builds a client for the workspace from config. The config's HTTPClient is replaced by the registry's
+// shared http client; the caller's config is left untouched.
+func (r *Registry) Register(workspace string, config *Config) (*Client, error) {
+	if workspace == "" {
+		return nil, errors.New("goengage: workspace is required")
+	}
+
+	if config == nil {
+		return nil, errors.New("goengage: config is required")
+	}
+
+	cfg := *config
+	cfg.HTTPClient = r.httpClient
+	c, err := New(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("goengage: workspace %v: %w", workspace, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.clients[workspace]; ok {
+		return nil, fmt.Errorf("goengage: workspace %v is already registered", workspace)
+	}
+	r.clients[workspace] = c
+	return c, nil
+}
+
+// Client returns the client of the workspace
+func (r *Registry) Client(workspace string) (*Client, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, ok := r.clients[workspace]
+	if !ok {
+		return nil, fmt.Errorf("goengage: workspace %v is not registered", workspace)
+	}
+	return c, nil
+}
+
+// Workspaces returns the registered workspace keys in alphabetical order
+func (r *Registry) Workspaces() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	workspaces := make([]string, 0, len(r.clients))
+	for workspace := range r.clients {
+		workspaces = append(workspaces, workspace)
+	}
+	sort.Strings(workspaces)
+	return workspaces
+}
+
+// ForEach calls fn concurrently for every workspace and returns one result per workspace in alphabetical order
+func (r *Registry) ForEach(fn func(workspace string, c *Client) error) []WorkspaceResult {
+	workspaces := r.Workspaces()
+	results := make([]WorkspaceResult, len(workspaces))
+
+	var wg sync.WaitGroup
+	for i, workspace := range workspaces {
+		c, err := r.Client(workspace)
+		if err != nil {
+			results[i] = WorkspaceResult{Workspace: workspace, Err: err}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, workspace string, c *Client) {
+			defer wg.Done()
+			results[i] = WorkspaceResult{Workspace: workspace, Err: fn(workspace, c)}
+		}(i, workspace, c)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// AddEvent adds the event to the user in every workspace the user belongs to. Workspaces where the user doesn't
+// exist are skipped and left out of the results.
+func (r *Registry) AddEvent(uid string, event *AddUserEvent) []WorkspaceResult {
+	var results []WorkspaceResult
+	for _, result := range r.ForEach(func(workspace string, c *Client) error {
+		if _, err := c.Users.Get(uid); err != nil {
+			var apiErr Error
+			if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+				return errNotInWorkspace
+			}
+			return err
+		}
+		return c.Users.AddEvent(uid, event)
+	}) {
+		if result.Err != errNotInWorkspace {
+			results = append(results, result)
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,195 @@
+package goengage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultRateLimitBackoff is how long requests are held off after a rate limited response without a Retry-After header
+const defaultRateLimitBackoff = time.Second
+
+type (
+	// rateLimiter is a token bucket shared by every request of a client. It is also paused when the API rate limits a
+	// request, so concurrent requests back off together instead of hammering the API.
+	rateLimiter struct {
+		mu     sync.Mutex
+		rate   float64
+		burst  float64
+		tokens float64
+		last   time.Time
+		// until is when a pause ends
+		until time.Time
+	}
+)
+
+// shouldRetry reports whether a failed request is safe to send again. Rate limited requests were not processed, so
+// they are always retried. Server errors and network failures are only retried for idempotent methods. Responses
+// that are too large or aren't valid JSON would be the same when sent again, so they are never retried.
+func shouldRetry(req *http.Request, err error) bool {
+	if req.Context().Err() != nil || errors.Is(err, errNotModified) || errors.Is(err, ErrResponseTooLarge) {
+		return false
+	}
+
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return false
+	}
+
+	var apiErr Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == http.StatusTooManyRequests:
+			return true
+		case apiErr.Code >= http.StatusInternalServerError:
+			return isIdempotent(req.Method)
+		}
+		return false
+	}
+
+	return isIdempotent(req.Method)
+}
+
+// maxRetries returns how many times a request that failed with err may be retried. Requests of bulk operations are
+// expected to hit the rate limit, so they are retried at least bulkRateLimitRetries times when rate limited.
+func (c *Client) maxRetries(req *http.Request, err error) int {
+	var apiErr Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests && isBulkRequest(req.Context()) &&
+		c.retry.MaxRetries < bulkRateLimitRetries {
+		return bulkRateLimitRetries
+	}
+	return c.retry.MaxRetries
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// backoff returns how long to wait before the retry following attempt
+func (p RetryPolicy) backoff(attempt int, err error) time.Duration {
+	delay := p.MinBackoff
+	for i := 0; i < attempt && (p.MaxBackoff <= 0 || delay < p.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	var apiErr Error
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > delay {
+		delay = apiErr.RetryAfter
+	}
+	return delay
+}
+
+// rewind returns a copy of req with a fresh body so it can be sent again
+func rewind(req *http.Request) (*http.Request, error) {
+	retry := req.Clone(req.Context())
+	if req.Body == nil || req.GetBody == nil {
+		return retry, nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	retry.Body = body
+	return retry, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// newRateLimiter returns a limiter that is only ever paused when limit is the zero value
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.RequestsPerSecond <= 0 {
+		return &rateLimiter{}
+	}
+
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:   limit.RequestsPerSecond,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until the limiter isn't paused and then takes a token from the bucket, blocking until one is available
+// or ctx is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+
+	l.mu.Lock()
+	if pause := time.Until(l.until); pause > 0 {
+		l.mu.Unlock()
+		if err := sleep(ctx, pause); err != nil {
+			return err
+		}
+		l.mu.Lock()
+	}
+
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	return sleep(ctx, delay)
+}
+
+// pause holds off every request waiting on the limiter for at least the delay asked by a rate limited response
+func (l *rateLimiter) pause(err error) {
+	var apiErr Error
+	if l == nil || !errors.As(err, &apiErr) || apiErr.Code != http.StatusTooManyRequests {
+		return
+	}
+
+	delay := apiErr.RetryAfter
+	if delay <= 0 {
+		delay = defaultRateLimitBackoff
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(delay); until.After(l.until) {
+		l.until = until
+	}
+}
@@ -0,0 +1,358 @@
+package goengage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ValidationOff sends events without checking them
+	ValidationOff ValidationMode = iota
+	// ValidationWarn logs events that don't match their schema through Config.Logger but still sends them
+	ValidationWarn
+	// ValidationStrict rejects events that don't match their schema with an *EventValidationError
+	ValidationStrict
+)
+
+const (
+	PropertyString  PropertyType = "string"
+	PropertyNumber  PropertyType = "number"
+	PropertyInteger PropertyType = "integer"
+	PropertyBool    PropertyType = "boolean"
+	// PropertyTime accepts a time.Time or an RFC 3339 string
+	PropertyTime PropertyType = "date-time"
+	// PropertyAny accepts any value
+	PropertyAny PropertyType = ""
+)
+
+type (
+	// ValidationMode decides what happens to events that don't match the EventRegistry
+	ValidationMode int
+
+	// PropertyType is the type of event property values. The names follow JSON Schema.
+	PropertyType string
+
+	PropertySchema struct {
+		Type     PropertyType
+		Required bool
+	}
+
+	// EventSchema describes the properties of an event. Properties not listed are rejected unless
+	// AdditionalProperties is true.
+	EventSchema struct {
+		Properties           map[string]PropertySchema
+		AdditionalProperties bool
+	}
+
+	// EventRegistry declares the events an application sends and the properties they carry, so typos in event names
+	// or properties are caught before they reach engage.so. Set it with Config.WithEventRegistry. Events that aren't
+	// registered are treated as invalid. It is safe for concurrent use.
+	EventRegistry struct {
+		mu      sync.RWMutex
+		mode    ValidationMode
+		schemas map[string]EventSchema
+	}
+
+	// EventValidationError lists every way an event differs from its schema
+	EventValidationError struct {
+		Event    string
+		Problems []string
+	}
+
+	// jsonSchema is the subset of JSON Schema understood by RegisterJSONSchema
+	jsonSchema struct {
+		Type                 string                        `json:"type"`
+		Properties           map[string]jsonSchemaProperty `json:"properties"`
+		Required             []string                      `json:"required"`
+		AdditionalProperties *bool                         `json:"additionalProperties"`
+	}
+
+	jsonSchemaProperty struct {
+		Type   string `json:"type"`
+		Format string `json:"format"`
+	}
+
+	// eventChecker is implemented by Users so handlers can check a whole batch of events before sending any of them
+	eventChecker interface {
+		checkEvent(event *AddUserEvent) error
+	}
+)
+
+// NewEventRegistry returns an empty registry validating events in mode
+func NewEventRegistry(mode ValidationMode) *EventRegistry {
+	return &EventRegistry{
+		mode:    mode,
+		schemas: map[string]EventSchema{},
+	}
+}
+
+// Mode returns the validation mode
+func (r *EventRegistry) Mode() ValidationMode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mode
+}
+
+// SetMode changes the validation mode, e.g. from ValidationWarn to ValidationStrict once no more warnings are logged
+func (r *EventRegistry) SetMode(mode ValidationMode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mode = mode
+}
+
+// Register declares event with schema, replacing any previous schema of the event
+func (r *EventRegistry) Register(event string, schema EventSchema) error {
+	if event == "" {
+		return errors.New("goengage: event name is required")
+	}
+
+	properties := make(map[string]PropertySchema, len(schema.Properties))
+	for name, property := range schema.Properties {
+		switch property.Type {
+		case PropertyString, PropertyNumber, PropertyInteger, PropertyBool, PropertyTime, PropertyAny:
+		default:
+			return fmt.Errorf("goengage: property %v of event %v has unsupported type %q", name, event, property.Type)
+		}
+		properties[name] = property
+	}
+	schema.Properties = properties
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas[event] = schema
+	return nil
+}
+
+// RegisterStruct declares event with the properties of the struct v. Properties are named by `engage:"name"` tags
+// like DecodeMeta. Pointer fields and fields tagged omitempty are optional, and other properties are rejected.
+//
+//	type SignedUp struct {
+//		Plan     string  `engage:"plan"`
+//		Referrer *string `engage:"referrer"`
+//	}
+//
+//	registry.RegisterStruct("signup", SignedUp{})
+func (r *EventRegistry) RegisterStruct(event string, v interface{}) error {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == nil || t.Kind() != reflect.Struct {
+		return fmt.Errorf("goengage: schema of event %v must be a struct, not %T", event, v)
+	}
+
+	schema := EventSchema{Properties: map[string]PropertySchema{}}
+	for _, field := range metaFields(t) {
+		ft := t.FieldByIndex(field.index).Type
+		optional := field.omitEmpty || ft.Kind() == reflect.Ptr
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		propertyType, ok := propertyTypeOf(ft)
+		if !ok {
+			return fmt.Errorf("goengage: property %v of event %v has unsupported type %v", field.name, event, ft)
+		}
+		schema.Properties[field.name] = PropertySchema{Type: propertyType, Required: !optional}
+	}
+
+	return r.Register(event, schema)
+}
+
+// RegisterJSONSchema declares event with a JSON Schema describing its properties. Only flat object schemas are
+// supported: properties of type string (optionally with format date-time), number, integer or boolean, required and
+// additionalProperties. Other keywords are ignored.
+//
+//	{
+//		"type": "object",
+//		"properties": {"plan": {"type": "string"}, "referrer": {"type": "string"}},
+//		"required": ["plan"],
+//		"additionalProperties": false
+//	}
+func (r *EventRegistry) RegisterJSONSchema(event string, schema []byte) error {
+	var js jsonSchema
+	if err := json.Unmarshal(schema, &js); err != nil {
+		return fmt.Errorf("goengage: invalid schema for event %v: %w", event, err)
+	}
+
+	if js.Type != "" && js.Type != "object" {
+		return fmt.Errorf("goengage: schema of event %v must be an object, not %v", event, js.Type)
+	}
+
+	output := EventSchema{
+		Properties:           map[string]PropertySchema{},
+		AdditionalProperties: js.AdditionalProperties == nil || *js.AdditionalProperties,
+	}
+	for name, property := range js.Properties {
+		propertyType := PropertyType(property.Type)
+		if propertyType == PropertyString && property.Format == "date-time" {
+			propertyType = PropertyTime
+		}
+		output.Properties[name] = PropertySchema{Type: propertyType}
+	}
+
+	for _, name := range js.Required {
+		property, ok := output.Properties[name]
+		if !ok {
+			property = PropertySchema{Type: PropertyAny}
+		}
+		property.Required = true
+		output.Properties[name] = property
+	}
+
+	return r.Register(event, output)
+}
+
+// Validate checks event against its schema regardless of the mode. It returns an *EventValidationError when the
+// event isn't registered or its properties don't match, and a plain error when event is nil.
+func (r *EventRegistry) Validate(event *AddUserEvent) error {
+	if event == nil {
+		return errors.New("goengage: event is required")
+	}
+
+	r.mu.RLock()
+	schema, ok := r.schemas[event.Event]
+	r.mu.RUnlock()
+
+	if !ok {
+		return &EventValidationError{Event: event.Event, Problems: []string{"event is not registered"}}
+	}
+
+	var problems []string
+	for name, property := range schema.Properties {
+		value, ok := event.Properties[name]
+		if !ok {
+			if property.Required {
+				problems = append(problems, fmt.Sprintf("%v is required", name))
+			}
+			continue
+		}
+
+		if !property.Type.matches(value) {
+			problems = append(problems, fmt.Sprintf("%v must be of type %v, got %T", name, property.Type, value))
+		}
+	}
+
+	if !schema.AdditionalProperties {
+		for name := range event.Properties {
+			if _, ok := schema.Properties[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%v is not a known property", name))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &EventValidationError{Event: event.Event, Problems: problems}
+	}
+	return nil
+}
+
+// validateEvent applies the client's event registry, if any, according to its mode
+func (c *Client) validateEvent(event *AddUserEvent) error {
+	if c.events == nil {
+		return nil
+	}
+
+	mode := c.events.Mode()
+	if mode == ValidationOff {
+		return nil
+	}
+
+	err := c.events.Validate(event)
+	if err != nil && mode == ValidationWarn {
+		c.logf("%v", err)
+		return nil
+	}
+	return err
+}
+
+// checkEvent returns the validation error AddEvent would return for event, without logging warnings
+func (c *Client) checkEvent(event *AddUserEvent) error {
+	if c.events == nil || c.events.Mode() != ValidationStrict {
+		return nil
+	}
+	return c.events.Validate(event)
+}
+
+// checkEventOf checks event when users supports it. Events are still validated when they are sent.
+func checkEventOf(users UserService, event *AddUserEvent) error {
+	if checker, ok := users.(eventChecker); ok {
+		return checker.checkEvent(event)
+	}
+	return nil
+}
+
+func (p PropertyType) matches(value interface{}) bool {
+	switch p {
+	case PropertyAny:
+		return true
+	case PropertyString:
+		_, ok := value.(string)
+		return ok
+	case PropertyBool:
+		_, ok := value.(bool)
+		return ok
+	case PropertyTime:
+		switch v := value.(type) {
+		case time.Time, *time.Time:
+			return true
+		case string:
+			_, err := time.Parse(time.RFC3339, v)
+			return err == nil
+		}
+		return false
+	}
+
+	// Numbers decoded with json.Decoder.UseNumber, such as the data of CloudEvents
+	if n, ok := value.(json.Number); ok {
+		if _, err := n.Int64(); err == nil {
+			return true
+		}
+		f, err := n.Float64()
+		return err == nil && (p == PropertyNumber || f == math.Trunc(f))
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Float32, reflect.Float64:
+		return p == PropertyNumber || v.Float() == math.Trunc(v.Float())
+	}
+	return false
+}
+
+func propertyTypeOf(t reflect.Type) (PropertyType, bool) {
+	if t == timeType {
+		return PropertyTime, true
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return PropertyString, true
+	case reflect.Bool:
+		return PropertyBool, true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return PropertyInteger, true
+	case reflect.Float32, reflect.Float64:
+		return PropertyNumber, true
+	case reflect.Interface:
+		return PropertyAny, true
+	}
+	return "", false
+}
+
+func (e *EventValidationError) Error() string {
+	return fmt.Sprintf("goengage: invalid event %q: %v", e.Event, strings.Join(e.Problems, "; "))
+}
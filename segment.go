@@ -0,0 +1,295 @@
+package goengage
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+)
+
+// segmentMaxBodySize is the largest request accepted by SegmentHandler, the same as Segment's batch limit
+const segmentMaxBodySize int64 = 500 * 1024
+
+// ErrInvalidSegmentMessage is wrapped by the errors of Segment calls that can't be applied as they are
+var ErrInvalidSegmentMessage = errors.New("goengage: invalid segment message")
+
+type (
+	// SegmentMessage is an identify, track or group call of the Segment spec. Fields engage.so has no use for, such
+	// as context and integrations, are ignored. See https://segment.com/docs/connections/spec/
+	SegmentMessage struct {
+		Type        string                 `json:"type"`
+		MessageId   string                 `json:"messageId,omitempty"`
+		UserId      string                 `json:"userId,omitempty"`
+		AnonymousId string                 `json:"anonymousId,omitempty"`
+		Event       string                 `json:"event,omitempty"`
+		GroupId     string                 `json:"groupId,omitempty"`
+		Traits      map[string]interface{} `json:"traits,omitempty"`
+		Properties  map[string]interface{} `json:"properties,omitempty"`
+		Timestamp   *time.Time             `json:"timestamp,omitempty"`
+	}
+
+	// SegmentAdapter maps Segment calls onto the user service, so existing Segment instrumentation can send to
+	// engage.so:
+	//
+	//   - identify updates the user's attributes, and creates the user if they don't exist yet. The firstName,
+	//     lastName, email, phone and createdAt traits (or their snake_case forms) map to the user's attributes and
+	//     other traits are stored in Meta.
+	//   - track adds an event with the call's properties and timestamp. The messageId is used as the idempotency key.
+	//   - group stores the groupId and the group's traits, prefixed with "group_", in the user's Meta.
+	//
+	// Users are identified by userId, or by anonymousId when there's no userId.
+	SegmentAdapter struct {
+		Users UserService
+	}
+
+	// SegmentHandler serves the Segment tracking API (/identify, /track, /group and /batch, under any prefix such as
+	// /v1) and forwards the calls to Adapter. When WriteKey is set, requests must authenticate with it as the basic
+	// auth username, like they do with Segment.
+	//
+	// Batches are checked as a whole first, and a batch with an invalid message is rejected with a 400 before any of
+	// its messages is applied. Batches aren't atomic though: when the API fails some of the calls, the others are
+	// still applied and the response is a 502 listing the failures. Segment libraries then send the whole batch again,
+	// which repeats the calls that went through; track calls carry their messageId as idempotency key so they aren't
+	// added twice, but set Config.Dedup to skip them on the client as well.
+	SegmentHandler struct {
+		Adapter  *SegmentAdapter
+		WriteKey string
+	}
+
+	segmentBatch struct {
+		Batch []*SegmentMessage `json:"batch"`
+	}
+
+	// segmentFailure is a call of a request that couldn't be applied, by its index in the batch
+	segmentFailure struct {
+		Index int    `json:"index"`
+		Error string `json:"error"`
+	}
+)
+
+// Handle applies a Segment call
+func (a *SegmentAdapter) Handle(ctx context.Context, msg *SegmentMessage) error {
+	uid, err := msg.check()
+	if err != nil {
+		return err
+	}
+
+	switch msg.Type {
+	case "identify":
+		return a.identify(ctx, uid, msg.Traits)
+	case "track":
+		return addEventContext(ctx, a.Users, uid, &AddUserEvent{
+			Event:          msg.Event,
+			Properties:     msg.Properties,
+			Timestamp:      msg.Timestamp,
+			IdempotencyKey: msg.MessageId,
+		})
+	}
+
+	traits := map[string]interface{}{"group_id": msg.GroupId}
+	for k, v := range msg.Traits {
+		traits["group_"+k] = v
+	}
+	return a.identify(ctx, uid, traits)
+}
+
+// check returns the uid of a call that can be applied, or an error wrapping ErrInvalidSegmentMessage
+func (msg *SegmentMessage) check() (string, error) {
+	if msg == nil {
+		return "", fmt.Errorf("%w: message is null", ErrInvalidSegmentMessage)
+	}
+
+	uid := msg.UserId
+	if uid == "" {
+		uid = msg.AnonymousId
+	}
+	if uid == "" {
+		return "", fmt.Errorf("%w: neither userId nor anonymousId is set", ErrInvalidSegmentMessage)
+	}
+
+	switch msg.Type {
+	case "identify":
+	case "track":
+		if msg.Event == "" {
+			return "", fmt.Errorf("%w: track without event", ErrInvalidSegmentMessage)
+		}
+	case "group":
+		if msg.GroupId == "" {
+			return "", fmt.Errorf("%w: group without groupId", ErrInvalidSegmentMessage)
+		}
+	default:
+		return "", fmt.Errorf("%w: unsupported type %q", ErrInvalidSegmentMessage, msg.Type)
+	}
+	return uid, nil
+}
+
+// HandleJSON decodes a Segment call and applies it
+func (a *SegmentAdapter) HandleJSON(ctx context.Context, data []byte) error {
+	var msg SegmentMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSegmentMessage, err)
+	}
+	return a.Handle(ctx, &msg)
+}
+
+// identify updates the user's attributes from traits, creating the user when they don't exist
+func (a *SegmentAdapter) identify(ctx context.Context, uid string, traits map[string]interface{}) error {
+	var (
+		input     UpdateUserAttributesInput
+		createdAt *time.Time
+	)
+
+	for k, v := range traits {
+		s, isString := v.(string)
+		switch k {
+		case "firstName", "first_name":
+			if isString {
+				input.FirstName = Set(s)
+				continue
+			}
+		case "lastName", "last_name":
+			if isString {
+				input.LastName = Set(s)
+				continue
+			}
+		case "email":
+			if isString {
+				input.Email = Set(s)
+				continue
+			}
+		case "phone":
+			if isString {
+				input.Number = Set(s)
+				continue
+			}
+		case "createdAt", "created_at":
+			if t, err := time.Parse(time.RFC3339, s); isString && err == nil {
+				createdAt = &t
+				continue
+			}
+		}
+
+		if input.Meta == nil {
+			input.Meta = map[string]interface{}{}
+		}
+		input.Meta[k] = v
+	}
+
+	_, err := updateAttributesContext(ctx, a.Users, uid, &input)
+	var apiErr Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+		return err
+	}
+
+	create := &CreateUserInput{Id: uid, CreatedAt: createdAt, Meta: input.Meta}
+	create.FirstName = optionalPtr(input.FirstName)
+	create.LastName = optionalPtr(input.LastName)
+	create.Email = optionalPtr(input.Email)
+	create.Number = optionalPtr(input.Number)
+
+	_, err = createContext(ctx, a.Users, create)
+	return err
+}
+
+// optionalPtr returns a pointer to the value of o, or nil when it has none
+func optionalPtr[T any](o Optional[T]) *T {
+	if v, ok := o.Get(); ok {
+		return &v
+	}
+	return nil
+}
+
+func (h *SegmentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.WriteKey != "" {
+		// Compared in constant time so response timings don't reveal how much of the key matched
+		key, _, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(key), []byte(h.WriteKey)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="segment"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, segmentMaxBodySize))
+	if err != nil {
+		http.Error(w, "Request body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var messages []*SegmentMessage
+	switch call := path.Base(r.URL.Path); call {
+	case "batch", "import":
+		var batch segmentBatch
+		if err := json.Unmarshal(body, &batch); err != nil {
+			http.Error(w, "Invalid batch", http.StatusBadRequest)
+			return
+		}
+		messages = batch.Batch
+	case "identify", "track", "group":
+		var msg SegmentMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			http.Error(w, "Invalid message", http.StatusBadRequest)
+			return
+		}
+		// The endpoint decides the type of single calls
+		msg.Type = call
+		messages = append(messages, &msg)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	// Nothing is applied unless every call of the batch can be
+	var failures []segmentFailure
+	for i, msg := range messages {
+		if _, err := msg.check(); err != nil {
+			failures = append(failures, segmentFailure{Index: i, Error: err.Error()})
+		}
+	}
+	if len(failures) > 0 {
+		writeSegmentFailures(w, http.StatusBadRequest, failures)
+		return
+	}
+
+	status := http.StatusOK
+	for i, msg := range messages {
+		err := h.Adapter.Handle(r.Context(), msg)
+		if err == nil {
+			continue
+		}
+
+		failures = append(failures, segmentFailure{Index: i, Error: err.Error()})
+		var validationErr *EventValidationError
+		if !errors.As(err, &validationErr) {
+			status = http.StatusBadGateway
+		} else if status == http.StatusOK {
+			status = http.StatusBadRequest
+		}
+	}
+
+	if len(failures) > 0 {
+		writeSegmentFailures(w, status, failures)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
+
+// writeSegmentFailures responds with the calls that couldn't be applied
+func writeSegmentFailures(w http.ResponseWriter, status int, failures []segmentFailure) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "failures": failures})
+}
@@ -0,0 +1,97 @@
+package goengage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+type (
+	// Event is implemented by typed events sent with Track. Properties are the fields tagged `engage:"name"`, mapped
+	// like MetaOf, and a field tagged `engage:",value"` is sent as the event's Value:
+	//
+	//	type OrderPlaced struct {
+	//		Amount   float64 `engage:",value"`
+	//		Currency string  `engage:"currency"`
+	//	}
+	//
+	//	func (OrderPlaced) EventName() string { return "order_placed" }
+	Event interface {
+		EventName() string
+	}
+
+	// contextEventAdder is implemented by Users so Track can pass its context through to the request
+	contextEventAdder interface {
+		addEvent(ctx context.Context, uid string, event *AddUserEvent) error
+	}
+)
+
+// Track sends a typed event for the user. It goes through Users.AddEvent, so events are validated against
+// Config.Events like any other event.
+//
+//	err := goengage.Track(ctx, client, "user_uid", OrderPlaced{Amount: 25, Currency: "USD"})
+func Track[E Event](ctx context.Context, client *Client, uid string, event E) error {
+	if client == nil {
+		return errors.New("goengage: client is required")
+	}
+
+	input, err := EventOf(event)
+	if err != nil {
+		return err
+	}
+
+	return addEventContext(ctx, client.Users, uid, input)
+}
+
+// EventOf converts a typed event to the AddUserEvent sent by Track
+func EventOf[E Event](event E) (*AddUserEvent, error) {
+	if v := reflect.ValueOf(event); !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil()) {
+		return nil, errors.New("goengage: event is nil")
+	}
+
+	properties, err := MetaOf(event)
+	if err != nil {
+		return nil, fmt.Errorf("goengage: event %v: %w", event.EventName(), err)
+	}
+
+	input := &AddUserEvent{Event: event.EventName(), Properties: properties}
+	if len(properties) == 0 {
+		input.Properties = nil
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(event))
+	if index, ok := eventValueField(v.Type()); ok {
+		value := v.FieldByIndex(index)
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return input, nil
+			}
+			value = value.Elem()
+		}
+		input.Value = value.Interface()
+	}
+
+	return input, nil
+}
+
+// RegisterEvent declares the typed event E in registry using RegisterStruct. E can be a struct or a pointer to one.
+func RegisterEvent[E Event](registry *EventRegistry) error {
+	var event E
+	// EventName is called on a zero value, which must not be a nil pointer or interface
+	switch t := reflect.TypeOf((*E)(nil)).Elem(); t.Kind() {
+	case reflect.Interface:
+		return fmt.Errorf("goengage: event type %v must be a concrete type", t)
+	case reflect.Ptr:
+		event = reflect.New(t.Elem()).Interface().(E)
+	}
+	return registry.RegisterStruct(event.EventName(), event)
+}
+
+// addEventContext adds the event with ctx when users supports it, and falls back to AddEvent otherwise
+func addEventContext(ctx context.Context, users UserService, uid string, event *AddUserEvent) error {
+	if adder, ok := users.(contextEventAdder); ok {
+		return adder.addEvent(ctx, uid, event)
+	}
+	return users.AddEvent(uid, event)
+}
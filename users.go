@@ -1,13 +1,11 @@
 package goengage
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
-	"strconv"
 	"time"
 )
 
@@ -18,6 +16,12 @@ type (
 		List(input *PaginatorInput) (*ListUserOutput, error)
 		UpdateAttributes(uid string, input *UpdateUserAttributesInput) (*UserOutput, error)
 		AddEvent(uid string, event *AddUserEvent) error
+		AddEvents(ctx context.Context, events []UserEvent) (*AddEventsOutput, error)
+		Delete(uid string) (*DeleteUserOutput, error)
+		Merge(sourceUid, destinationUid string) (*MergeUserOutput, error)
+		AddDevice(uid string, input *AddDeviceInput) (*UserOutput, error)
+		RemoveDevice(uid, token string) error
+		ListDevices(uid string) ([]UserDevice, error)
 	}
 
 	Users service
@@ -35,13 +39,19 @@ type (
 		Segments     []UserSegment          `json:"segments"`
 		Meta         map[string]interface{} `json:"meta"`
 		CreatedAt    time.Time              `json:"created_at"`
+		// ETag and LastModified are the validators returned by the API, if any. Pass ETag as
+		// UpdateUserAttributesInput.IfMatch to only update the user if it hasn't changed since.
+		ETag         string `json:"-"`
+		LastModified string `json:"-"`
 	}
 
 	UserDevice struct {
-		Token    string `json:"token"`
-		Platform string `json:"platform"`
+		Token    string         `json:"token"`
+		Platform DevicePlatform `json:"platform"`
 	}
 
+	DevicePlatform string
+
 	UserList struct {
 		Id         string `json:"id"`
 		Subscribed bool   `json:"subscribed"`
@@ -57,20 +67,58 @@ type (
 		NextCursor string        `json:"next_cursor"`
 		PrevCursor string        `json:"prev_cursor"`
 	}
+
+	DeleteUserOutput struct {
+		Status string `json:"status"`
+	}
+
+	MergeUserOutput struct {
+		Status string `json:"status"`
+		Url    string `json:"url"`
+	}
+
+	// contextUserCreator is implemented by Users so callers with a context can pass it through to the request
+	contextUserCreator interface {
+		create(ctx context.Context, input *CreateUserInput) (*UserOutput, error)
+	}
+
+	// contextAttributesUpdater is implemented by Users so callers with a context can pass it through to the request
+	contextAttributesUpdater interface {
+		updateAttributes(ctx context.Context, uid string, input *UpdateUserAttributesInput) (*UserOutput, error)
+	}
 )
 
+const (
+	DevicePlatformAndroid DevicePlatform = "android"
+	DevicePlatformIos     DevicePlatform = "ios"
+)
+
+// Valid reports whether the platform is one supported by engage.so
+func (p DevicePlatform) Valid() bool {
+	switch p {
+	case DevicePlatformAndroid, DevicePlatformIos:
+		return true
+	}
+	return false
+}
+
 // Create create a new user - Documentation Link: https://engage.so/docs/api/users#create-a-user
 func (u *Users) Create(input *CreateUserInput) (*UserOutput, error) {
+	return u.create(context.Background(), input)
+}
+
+func (u *Users) create(ctx context.Context, input *CreateUserInput) (*UserOutput, error) {
 	if input.Id == "" {
 		return nil, errors.New("goengage: id is required")
 	}
 
-	payload, err := json.Marshal(input)
+	payload, err := encode(input)
 	if err != nil {
 		return nil, err
 	}
+	defer payload.release()
 
-	req, err := u.client.newRequest(http.MethodPost, "/users", bytes.NewReader(payload))
+	req, err := u.client.newRequestWithContext(ctx, http.MethodPost, "/users", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -86,42 +134,44 @@ func (u *Users) Create(input *CreateUserInput) (*UserOutput, error) {
 
 // Get fetches and returns a user's profile - Documentation Link: https://engage.so/docs/api/users#retrieve-a-user
 func (u *Users) Get(uid string) (*UserOutput, error) {
+	output, _, err := u.getIfModified(uid, nil)
+	return output, err
+}
+
+// getIfModified fetches the user unless it hasn't changed since cached was fetched, in which case cached is returned
+// along with true. cached can be nil.
+func (u *Users) getIfModified(uid string, cached *UserOutput) (*UserOutput, bool, error) {
 	if uid == "" {
-		return nil, errors.New("goengage: uid is required")
+		return nil, false, errors.New("goengage: uid is required")
 	}
 
 	req, err := u.client.newRequest(http.MethodGet, fmt.Sprintf("/users/%v", uid), nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	if cached != nil {
+		setConditionalHeaders(req, cached.ETag, cached.LastModified)
 	}
 
 	var output UserOutput
-	err = u.client.makeRequest(req, &output)
+	header, err := u.client.sendRequest(req, &output)
+	if errors.Is(err, errNotModified) && cached != nil {
+		return cached, true, nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return &output, err
+	output.ETag = header.Get("ETag")
+	output.LastModified = header.Get("Last-Modified")
+	return &output, false, err
 }
 
 // List returns a list of users. - Documentation Link: https://engage.so/docs/api/users#list-users
 func (u *Users) List(input *PaginatorInput) (*ListUserOutput, error) {
-
-	if input.NextCursor != nil && input.PrevCursor != nil {
-		return nil, errors.New("goengage: Cannot use Next and Prev cursor at the same time")
-	}
-
-	params := url.Values{}
-	if input.Limit != nil {
-		params.Add("limit", strconv.Itoa(*input.Limit))
-	}
-
-	if input.NextCursor != nil && input.PrevCursor == nil {
-		params.Add("next_cursor", *input.NextCursor)
-	}
-
-	if input.PrevCursor != nil && input.NextCursor == nil {
-		params.Add("prev_cursor", *input.PrevCursor)
+	params, err := input.values()
+	if err != nil {
+		return nil, err
 	}
 
 	req, err := u.client.newRequest(http.MethodGet, fmt.Sprintf("/users?%v", params.Encode()), nil)
@@ -138,21 +188,30 @@ func (u *Users) List(input *PaginatorInput) (*ListUserOutput, error) {
 	return &output, err
 }
 
-// UpdateAttributes updates user data and attributes. - Documentation Link: https://engage.so/docs/api/users#update-user-attributes
+// UpdateAttributes updates user data and attributes. A *ConflictError is returned when IfMatch is set and the user
+// changed since it was read. - Documentation Link: https://engage.so/docs/api/users#update-user-attributes
 func (u *Users) UpdateAttributes(uid string, input *UpdateUserAttributesInput) (*UserOutput, error) {
+	return u.updateAttributes(context.Background(), uid, input)
+}
+
+func (u *Users) updateAttributes(ctx context.Context, uid string, input *UpdateUserAttributesInput) (*UserOutput, error) {
 	if uid == "" {
 		return nil, errors.New("goengage: uid is required")
 	}
 
-	payload, err := json.Marshal(input)
+	payload, err := encode(input)
 	if err != nil {
 		return nil, err
 	}
+	defer payload.release()
 
-	req, err := u.client.newRequest(http.MethodPut, fmt.Sprintf("/users/%v", uid), bytes.NewReader(payload))
+	req, err := u.client.newRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("/users/%v", uid), payload)
 	if err != nil {
 		return nil, err
 	}
+	if input != nil && input.IfMatch != "" {
+		req.Header.Set("If-Match", input.IfMatch)
+	}
 
 	var output UserOutput
 	err = u.client.makeRequest(req, &output)
@@ -163,20 +222,198 @@ func (u *Users) UpdateAttributes(uid string, input *UpdateUserAttributesInput) (
 	return &output, err
 }
 
+// createContext creates the user through users, passing ctx through when users supports it
+func createContext(ctx context.Context, users UserService, input *CreateUserInput) (*UserOutput, error) {
+	if creator, ok := users.(contextUserCreator); ok {
+		return creator.create(ctx, input)
+	}
+	return users.Create(input)
+}
+
+// updateAttributesContext updates the user's attributes through users, passing ctx through when users supports it
+func updateAttributesContext(ctx context.Context, users UserService, uid string, input *UpdateUserAttributesInput) (*UserOutput, error) {
+	if updater, ok := users.(contextAttributesUpdater); ok {
+		return updater.updateAttributes(ctx, uid, input)
+	}
+	return users.UpdateAttributes(uid, input)
+}
+
 // AddEvent Add user events. It returns an error if any or nil if operation successful. Successful == 200 status code
+// Events are first checked against Config.Events, if set.
 // Documentation Link: https://engage.so/docs/api/users#add-user-events
 func (u *Users) AddEvent(uid string, event *AddUserEvent) error {
+	return u.addEvent(context.Background(), uid, event)
+}
+
+func (u *Users) checkEvent(event *AddUserEvent) error {
+	return u.client.checkEvent(event)
+}
+
+func (u *Users) addEvent(ctx context.Context, uid string, event *AddUserEvent) error {
 	if uid == "" {
 		return errors.New("goengage: uid is required")
 	}
 
-	payload, err := json.Marshal(event)
+	if event == nil {
+		return errors.New("goengage: event is required")
+	}
+
+	if err := u.client.validateEvent(event); err != nil {
+		return err
+	}
+
+	duplicate, err := u.client.beginEvent(event)
+	if err != nil || duplicate {
+		return err
+	}
+
+	err = u.sendEvent(ctx, uid, event)
+	u.client.endEvent(event, err == nil)
+	return err
+}
+
+// sendEvent sends a single event without validating or deduplicating it
+func (u *Users) sendEvent(ctx context.Context, uid string, event *AddUserEvent) error {
+	payload, err := encode(event)
+	if err != nil {
+		return err
+	}
+	defer payload.release()
+
+	req, err := u.client.newRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("/users/%v/events", uid), payload)
 	if err != nil {
 		return err
+	}
+	if event.IdempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", event.IdempotencyKey)
+	}
+
+	var output map[string]string
+	return u.client.makeRequest(req, &output)
+}
+
+// Delete deletes a user and all their data - Documentation Link: https://engage.so/docs/api/users#delete-a-user
+func (u *Users) Delete(uid string) (*DeleteUserOutput, error) {
+	if uid == "" {
+		return nil, errors.New("goengage: uid is required")
+	}
+
+	req, err := u.client.newRequest(http.MethodDelete, fmt.Sprintf("/users/%v", uid), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var output DeleteUserOutput
+	err = u.client.makeRequest(req, &output)
+	if err != nil {
+		return nil, err
+	}
+
+	return &output, err
+}
+
+// Merge merges the source user into the destination user. The source user is deleted once the merge completes.
+// Documentation Link: https://engage.so/docs/api/users#merge-users
+func (u *Users) Merge(sourceUid, destinationUid string) (*MergeUserOutput, error) {
+	if sourceUid == "" {
+		return nil, errors.New("goengage: source uid is required")
+	}
+
+	if destinationUid == "" {
+		return nil, errors.New("goengage: destination uid is required")
+	}
+
+	if sourceUid == destinationUid {
+		return nil, errors.New("goengage: cannot merge a user into itself")
+	}
+
+	payload, err := encode(&mergeUserInput{
+		Source:      sourceUid,
+		Destination: destinationUid,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer payload.release()
+
+	req, err := u.client.newRequest(http.MethodPost, "/users/merge", payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var output MergeUserOutput
+	err = u.client.makeRequest(req, &output)
+	if err != nil {
+		return nil, err
+	}
+
+	return &output, err
+}
+
+// EraseUser removes a user from every list they belong to and then deletes the user.
+// It is meant for GDPR-style erasure requests where no trace of the user should remain in any list.
+func (c *Client) EraseUser(uid string) (*DeleteUserOutput, error) {
+	user, err := c.Users.Get(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, list := range user.Lists {
+		if err := c.Lists.UnsubscribeList(list.Id, uid); err != nil {
+			return nil, fmt.Errorf("goengage: unable to remove user from list %v: %w", list.Id, err)
+		}
+	}
 
+	return c.Users.Delete(uid)
+}
+
+// AddDevice registers a device for push notifications on the user's profile. Existing devices are left untouched, so a
+// push token can be rotated by adding the new token and then removing the old one with RemoveDevice.
+// Documentation Link: https://engage.so/docs/api/users#update-user-attributes
+func (u *Users) AddDevice(uid string, input *AddDeviceInput) (*UserOutput, error) {
+	if uid == "" {
+		return nil, errors.New("goengage: uid is required")
+	}
+
+	if input.Token == "" {
+		return nil, errors.New("goengage: device token is required")
+	}
+
+	if !input.Platform.Valid() {
+		return nil, fmt.Errorf("goengage: unsupported device platform %q", input.Platform)
 	}
 
-	req, err := u.client.newRequest(http.MethodPut, fmt.Sprintf("/users/%v/events", uid), bytes.NewReader(payload))
+	payload, err := encode(input)
+	if err != nil {
+		return nil, err
+	}
+	defer payload.release()
+
+	req, err := u.client.newRequest(http.MethodPut, fmt.Sprintf("/users/%v", uid), payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var output UserOutput
+	err = u.client.makeRequest(req, &output)
+	if err != nil {
+		return nil, err
+	}
+
+	return &output, err
+}
+
+// RemoveDevice removes a single device from the user's profile using the device token
+func (u *Users) RemoveDevice(uid, token string) error {
+	if uid == "" {
+		return errors.New("goengage: uid is required")
+	}
+
+	if token == "" {
+		return errors.New("goengage: device token is required")
+	}
+
+	req, err := u.client.newRequest(http.MethodDelete, fmt.Sprintf("/users/%v/devices/%v", uid, url.PathEscape(token)), nil)
 	if err != nil {
 		return err
 	}
@@ -184,3 +421,13 @@ func (u *Users) AddEvent(uid string, event *AddUserEvent) error {
 	var output map[string]string
 	return u.client.makeRequest(req, &output)
 }
+
+// ListDevices returns the devices registered on the user's profile
+func (u *Users) ListDevices(uid string) ([]UserDevice, error) {
+	user, err := u.Get(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.Devices, nil
+}